@@ -0,0 +1,136 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+)
+
+const Attempt = "attempt_x"
+
+// maxExcludedPicks is how often the child picker is asked again when it picks
+// a SubConn already used by the call, before one is chosen round robin.
+const maxExcludedPicks = 3
+
+var (
+	errPickExcluded     = status.Error(codes.Canceled, "grpclb: SubConn already used by another attempt")
+	errNoAttemptSubConn = status.Error(codes.Unavailable, "grpclb: no SubConn left for another attempt")
+)
+
+// AttemptName returns the name the attempt aware wrapper of the child balancer
+// is registered under.
+func AttemptName(child string) string {
+	return Attempt + "_" + child
+}
+
+// InitAttemptBuilder registers a balancer named AttemptName(child) that never
+// picks a SubConn already used by another attempt of the same call, as the
+// hedging and retry interceptors require. The outlier detection and circuit
+// breaker wrappers do the same, so they need no extra wrapper.
+func InitAttemptBuilder(child string) {
+	balancer.Register(&wrapperBuilder{
+		name:  AttemptName(child),
+		child: child,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return attemptWrapper{}
+		},
+	})
+}
+
+// attemptWrapper adds nothing, wrapperClientConn excludes the used SubConns.
+type attemptWrapper struct{}
+
+func (attemptWrapper) addSubConn(balancer.SubConn)                                {}
+func (attemptWrapper) removeSubConn(balancer.SubConn)                             {}
+func (attemptWrapper) updateSubConnState(balancer.SubConn, balancer.SubConnState) {}
+func (attemptWrapper) wrapPicker(picker balancer.Picker) balancer.Picker          { return picker }
+func (attemptWrapper) close()                                                     {}
+
+// attempts records the SubConns picked for the attempts of one call.
+type attempts struct {
+	mu     sync.Mutex
+	picked []balancer.SubConn
+}
+
+type attemptsKey struct{}
+
+func withAttempts(ctx context.Context, a *attempts) context.Context {
+	return context.WithValue(ctx, attemptsKey{}, a)
+}
+
+func attemptsFromContext(ctx context.Context) *attempts {
+	if ctx == nil {
+		return nil
+	}
+	a, _ := ctx.Value(attemptsKey{}).(*attempts)
+	return a
+}
+
+// add records sc and reports whether it was not used before.
+func (a *attempts) add(sc balancer.SubConn) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, picked := range a.picked {
+		if picked == sc {
+			return false
+		}
+	}
+	a.picked = append(a.picked, sc)
+	return true
+}
+
+// excludePicker keeps the attempts of a call on different SubConns. Calls
+// without attempts in their context go straight to the child picker. The
+// child picker gets the call without its attempts, so that the excludePicker
+// of a nested wrapper leaves the exclusion to the outermost one.
+type excludePicker struct {
+	picker balancer.Picker
+	ready  []balancer.SubConn
+	next   uint32
+}
+
+func newExcludePicker(picker balancer.Picker, ready []balancer.SubConn) balancer.Picker {
+	return &excludePicker{picker: picker, ready: ready}
+}
+
+func (p *excludePicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	a := attemptsFromContext(info.Ctx)
+	if a == nil {
+		return p.picker.Pick(info)
+	}
+	info.Ctx = withAttempts(info.Ctx, nil)
+	for i := 0; i < maxExcludedPicks; i++ {
+		ret, err := p.picker.Pick(info)
+		if err != nil || ret.SubConn == nil {
+			return ret, err
+		}
+		if a.add(ret.SubConn) {
+			return ret, nil
+		}
+		if ret.Done != nil {
+			ret.Done(balancer.DoneInfo{Err: errPickExcluded})
+		}
+	}
+
+	// the child keeps picking used SubConns, e.g. consistent hash
+	n := uint32(len(p.ready))
+	start := atomic.AddUint32(&p.next, 1)
+	for i := uint32(0); i < n; i++ {
+		sc := p.ready[(start+i)%n]
+		if a.add(sc) {
+			return pickSubConn(p.picker, info, sc), nil
+		}
+	}
+	return balancer.PickResult{}, errNoAttemptSubConn
+}
+
+// isNoAttemptSubConn reports whether err is errNoAttemptSubConn returned by
+// gRPC for the pick.
+func isNoAttemptSubConn(err error) bool {
+	s := status.Convert(err)
+	return s.Code() == codes.Unavailable && s.Message() == status.Convert(errNoAttemptSubConn).Message()
+}
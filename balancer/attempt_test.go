@@ -0,0 +1,161 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// subConnTestPicker always picks sc and records the errors its picks are done
+// with.
+type subConnTestPicker struct {
+	sc balancer.SubConn
+
+	mu   sync.Mutex
+	done []error
+}
+
+func (p *subConnTestPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	ret, _ := p.pickSubConn(info, p.sc)
+	return ret, nil
+}
+
+func (p *subConnTestPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return balancer.PickResult{
+		SubConn: sc,
+		Done: func(info balancer.DoneInfo) {
+			p.mu.Lock()
+			p.done = append(p.done, info.Err)
+			p.mu.Unlock()
+		},
+	}, true
+}
+
+func testSubConns(n int) []balancer.SubConn {
+	var scs []balancer.SubConn
+	for i := 0; i < n; i++ {
+		scs = append(scs, &testSubConn{id: i})
+	}
+	return scs
+}
+
+// newTestAttemptConn builds the attempt wrapper of consistent hash on a
+// testClientConn with n ready SubConns. Without the wrapper all attempts of a
+// call made with testHashContext would go to the same SubConn.
+func newTestAttemptConn(t *testing.T, n int) (*testClientConn, *wrapperBalancer) {
+	InitAttemptBuilder(ConsistentHash)
+	return newTestWrapper(t, balancer.Get(AttemptName(ConsistentHash)), n)
+}
+
+func testHashContext() context.Context {
+	return context.WithValue(context.Background(), DefaultConsistentHashKey, "test-key")
+}
+
+// invoker returns a grpc.UnaryInvoker that picks a SubConn for every attempt
+// like gRPC does, and lets call answer it.
+func (cc *testClientConn) invoker(call func(ctx context.Context, sc balancer.SubConn) error) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, _ *grpc.ClientConn, opts ...grpc.CallOption) error {
+		ret, err := cc.pick(ctx)
+		if err != nil {
+			return err
+		}
+		err = call(ctx, ret.SubConn)
+		if ret.Done != nil {
+			ret.Done(balancer.DoneInfo{Err: err})
+		}
+		return err
+	}
+}
+
+// pickAttempts picks for the attempts of one call until the picker fails.
+func pickAttempts(t *testing.T, picker balancer.Picker) []balancer.PickResult {
+	info := balancer.PickInfo{Ctx: withAttempts(context.Background(), &attempts{})}
+	var picks []balancer.PickResult
+	for {
+		ret, err := picker.Pick(info)
+		if err == errNoAttemptSubConn {
+			return picks
+		}
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		for _, pick := range picks {
+			if pick.SubConn == ret.SubConn {
+				t.Fatalf("%v picked again for another attempt", ret.SubConn)
+			}
+		}
+		picks = append(picks, ret)
+	}
+}
+
+func TestExcludePicker(t *testing.T) {
+	scs := testSubConns(3)
+	child := &subConnTestPicker{sc: scs[0]}
+
+	picks := pickAttempts(t, newExcludePicker(child, scs))
+	if len(picks) != 3 {
+		t.Fatalf("%d attempts picked on 3 SubConns", len(picks))
+	}
+	// the child keeps picking scs[0], so the picks after the first one drop
+	// its picks and pick the other SubConns through it
+	if len(child.done) != 3*maxExcludedPicks {
+		t.Fatalf("%d dropped picks, want %d", len(child.done), 3*maxExcludedPicks)
+	}
+	for _, err := range child.done {
+		if !isDroppedPick(err) {
+			t.Fatalf("pick dropped with %v", err)
+		}
+	}
+	for _, pick := range picks {
+		if pick.Done == nil {
+			t.Fatalf("pick of %v skipped the child", pick.SubConn)
+		}
+	}
+
+	// only the outermost of nested wrappers excludes SubConns
+	nested := newExcludePicker(newExcludePicker(child, scs), scs)
+	if picks := pickAttempts(t, nested); len(picks) != 3 {
+		t.Fatalf("%d attempts picked on 3 SubConns through nested wrappers", len(picks))
+	}
+}
+
+func TestDroppedPicks(t *testing.T) {
+	t.Run(RoundRobin, func(t *testing.T) {
+		p := (&roundRobinPickerBuilder{}).Build(benchBuildInfo(3)).(*roundRobinPicker)
+		var node *weightedNode
+		for _, n := range p.nodes {
+			if n.weight == 3 {
+				node = n
+			}
+		}
+		p.track(node).Done(balancer.DoneInfo{Err: errPickExcluded})
+		p.track(node).Done(balancer.DoneInfo{Err: errPickLimited})
+		if got := atomic.LoadInt32(&node.effectiveWeight); got != 3 {
+			t.Fatalf("effective weight %d after dropped picks, want 3", got)
+		}
+		p.track(node).Done(balancer.DoneInfo{Err: errTestUnavailable})
+		if got := atomic.LoadInt32(&node.effectiveWeight); got != 2 {
+			t.Fatalf("effective weight %d after a failure, want 2", got)
+		}
+	})
+
+	t.Run(OutlierDetection, func(t *testing.T) {
+		cc, b, d := newTestOutlierDetector(t, OutlierDetectionConfig{ConsecutiveFailures: 2}, 2)
+		defer b.Close()
+		sc := cc.subConns[0]
+
+		d.record(sc, errTestUnavailable)
+		ret, _ := (&outlierDetectionPicker{picker: &subConnTestPicker{sc: sc}, d: d}).Pick(balancer.PickInfo{})
+		ret.Done(balancer.DoneInfo{Err: errPickExcluded})
+		if got := d.hosts[sc].consecutive; got != 1 {
+			t.Fatalf("%d consecutive failures after a dropped pick, want 1", got)
+		}
+		d.record(sc, errTestUnavailable)
+		if !d.hosts[sc].ejected {
+			t.Fatal("SubConn not ejected after two consecutive failures")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package balancer
+
+import (
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The pickers in this file are the implementations from before the pickers
+// became lock-free, reduced to their pick path. They are the baseline of the
+// parallel pick benchmarks.
+
+// baselinePickers builds the old picker of a policy.
+var baselinePickers = map[string]func(buildInfo base.PickerBuildInfo) balancer.Picker{
+	RoundRobin: func(buildInfo base.PickerBuildInfo) balancer.Picker {
+		return newLockedRoundRobinPicker(buildInfo, nil)
+	},
+	Random:          newLockedRandomPicker,
+	LeastConnection: newLockedLeastConnectionPicker,
+	WeightedLoad: func(buildInfo base.PickerBuildInfo) balancer.Picker {
+		// the load weights fall back to common.GetWeight without reports
+		return newLockedRoundRobinPicker(buildInfo, nil)
+	},
+	RendezvousHash: newLockedRendezvousPicker,
+}
+
+type lockedNode struct {
+	subConn         balancer.SubConn
+	weight          int
+	currentWeight   float64
+	effectiveWeight int
+	readySince      time.Time
+	inflight        int64
+}
+
+func lockedNodes(buildInfo base.PickerBuildInfo) []*lockedNode {
+	var nodes []*lockedNode
+	for sc, info := range buildInfo.ReadySCs {
+		weight := common.GetWeight(info.Address)
+		nodes = append(nodes, &lockedNode{subConn: sc, weight: weight, effectiveWeight: weight})
+	}
+	return nodes
+}
+
+// lockedRoundRobinPicker is the nginx smooth weighted round robin under a
+// mutex, computing every pick from the current weights of all nodes.
+type lockedRoundRobinPicker struct {
+	mu        sync.Mutex
+	nodes     []*lockedNode
+	slowStart *slowStart
+	warmUntil time.Time
+}
+
+func newLockedRoundRobinPicker(buildInfo base.PickerBuildInfo, s *slowStart) balancer.Picker {
+	p := &lockedRoundRobinPicker{nodes: lockedNodes(buildInfo), slowStart: s}
+	if s != nil {
+		p.warmUntil = s.update(buildInfo)
+		for _, node := range p.nodes {
+			node.readySince = s.readySince[node.subConn]
+		}
+	}
+	return p
+}
+
+func (p *lockedRoundRobinPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	var now time.Time
+	if p.slowStart != nil {
+		now = time.Now()
+	}
+	p.mu.Lock()
+	warming := p.slowStart != nil && now.Before(p.warmUntil)
+	var best *lockedNode
+	total := 0.0
+	for _, node := range p.nodes {
+		weight := float64(node.effectiveWeight)
+		if warming {
+			weight *= p.slowStart.factor(node.readySince, now)
+		}
+		node.currentWeight += weight
+		total += weight
+		if node.effectiveWeight < node.weight {
+			node.effectiveWeight++
+		}
+		if best == nil || node.currentWeight > best.currentWeight {
+			best = node
+		}
+	}
+	best.currentWeight -= total
+	p.mu.Unlock()
+
+	ret := balancer.PickResult{SubConn: best.subConn}
+	ret.Done = func(info balancer.DoneInfo) {
+		if info.Err == nil {
+			return
+		}
+		p.mu.Lock()
+		if best.effectiveWeight > 1 {
+			best.effectiveWeight--
+		}
+		p.mu.Unlock()
+	}
+	return ret, nil
+}
+
+// lockedRandomPicker draws from one random source under a mutex.
+type lockedRandomPicker struct {
+	mu       sync.Mutex
+	rand     *rand.Rand
+	subConns []balancer.SubConn
+}
+
+func newLockedRandomPicker(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &lockedRandomPicker{rand: rand.New(rand.NewSource(time.Now().Unix()))}
+	for _, node := range lockedNodes(buildInfo) {
+		for i := 0; i < node.weight; i++ {
+			p.subConns = append(p.subConns, node.subConn)
+		}
+	}
+	return p
+}
+
+func (p *lockedRandomPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	sc := p.subConns[p.rand.Intn(len(p.subConns))]
+	p.mu.Unlock()
+	return balancer.PickResult{SubConn: sc}, nil
+}
+
+// lockedLeastConnectionPicker compares two nodes drawn from one random source
+// under a mutex.
+type lockedLeastConnectionPicker struct {
+	mu    sync.Mutex
+	rand  *rand.Rand
+	nodes []*lockedNode
+}
+
+func newLockedLeastConnectionPicker(buildInfo base.PickerBuildInfo) balancer.Picker {
+	return &lockedLeastConnectionPicker{
+		rand:  rand.New(rand.NewSource(time.Now().Unix())),
+		nodes: lockedNodes(buildInfo),
+	}
+}
+
+func (p *lockedLeastConnectionPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	a, b := p.rand.Intn(len(p.nodes)), p.rand.Intn(len(p.nodes)-1)
+	p.mu.Unlock()
+	if b >= a {
+		b++
+	}
+	node := p.nodes[a]
+	if atomic.LoadInt64(&p.nodes[b].inflight) < atomic.LoadInt64(&node.inflight) {
+		node = p.nodes[b]
+	}
+	atomic.AddInt64(&node.inflight, 1)
+	return balancer.PickResult{
+		SubConn: node.subConn,
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(&node.inflight, -1)
+		},
+	}, nil
+}
+
+// lockedRendezvousPicker scores and sorts all nodes under a mutex on every
+// pick.
+type lockedRendezvousPicker struct {
+	mu           sync.Mutex
+	nodes        []*lockedNode
+	keyExtractor KeyExtractor
+}
+
+func newLockedRendezvousPicker(buildInfo base.PickerBuildInfo) balancer.Picker {
+	return &lockedRendezvousPicker{
+		nodes:        lockedNodes(buildInfo),
+		keyExtractor: newConsistentHashConfig(RendezvousHash, DefaultConsistentHashKey, nil).keyExtractor,
+	}
+}
+
+func (p *lockedRendezvousPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	key, _ := p.keyExtractor(info)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	type scored struct {
+		node  *lockedNode
+		score float64
+	}
+	candidates := make([]scored, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		f := fnv.New64a()
+		f.Write([]byte(node.subConn.(*benchSubConn).addr))
+		f.Write([]byte(Salt))
+		f.Write([]byte(key))
+		x := f.Sum64()
+		x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+		x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+		x ^= x >> 31
+		h := (float64(x>>11) + 0.5) / (1 << 53)
+		candidates = append(candidates, scored{node, float64(node.weight) / -math.Log(h)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+	return balancer.PickResult{SubConn: candidates[0].node.subConn}, nil
+}
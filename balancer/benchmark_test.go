@@ -0,0 +1,194 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type benchSubConn struct {
+	balancer.SubConn
+	id   int
+	addr string
+}
+
+// benchBuildInfo returns n ready SubConns with the weights 1, 2 and 3.
+func benchBuildInfo(n int) base.PickerBuildInfo {
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i := 0; i < n; i++ {
+		md := metadata.Pairs(common.WeightKey, strconv.Itoa(1+i%3))
+		addr := fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)
+		info.ReadySCs[&benchSubConn{id: i, addr: addr}] = base.SubConnInfo{
+			Address: resolver.Address{Addr: addr, Metadata: &md},
+		}
+	}
+	return info
+}
+
+func benchPickerBuilder(bb balancer.Builder) base.PickerBuilder {
+	return bb.(*configBuilder).newPickerBuilder(nil)
+}
+
+// benchChurn returns two ready sets of n SubConns that differ in one SubConn.
+func benchChurn(n int) [2]base.PickerBuildInfo {
+	a := benchBuildInfo(n + 1)
+	b := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for sc, info := range a.ReadySCs {
+		b.ReadySCs[sc] = info
+	}
+	var first, last balancer.SubConn
+	for sc := range a.ReadySCs {
+		switch sc.(*benchSubConn).id {
+		case 0:
+			first = sc
+		case n:
+			last = sc
+		}
+	}
+	delete(a.ReadySCs, last)
+	delete(b.ReadySCs, first)
+	return [2]base.PickerBuildInfo{a, b}
+}
+
+func benchConsistentHashPickerBuilder() base.PickerBuilder {
+	return benchPickerBuilder(NewConsistentHashBuilder("bench_consistent_hash_x", DefaultConsistentHashKey))
+}
+
+// BenchmarkConsistentHashRebuild compares building the ring of a new picker
+// from scratch with applying one SubConn joining and one leaving.
+func BenchmarkConsistentHashRebuild(b *testing.B) {
+	for _, n := range []int{100, 1000} {
+		infos := benchChurn(n)
+		b.Run(fmt.Sprintf("full/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				benchConsistentHashPickerBuilder().Build(infos[i%2])
+			}
+		})
+		b.Run(fmt.Sprintf("incremental/%d", n), func(b *testing.B) {
+			pb := benchConsistentHashPickerBuilder()
+			pb.Build(infos[1])
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pb.Build(infos[i%2])
+			}
+		})
+	}
+}
+
+// benchPickParallel picks from picker on all Ps at once. Every failEvery-th
+// call fails, if failEvery is not 0.
+func benchPickParallel(b *testing.B, picker balancer.Picker, failEvery int) {
+	infos := make([]balancer.PickInfo, 64)
+	for i := range infos {
+		infos[i] = balancer.PickInfo{
+			FullMethodName: "/bench.Service/Method",
+			Ctx:            context.WithValue(context.Background(), DefaultConsistentHashKey, strconv.Itoa(i)),
+		}
+	}
+	failed := balancer.DoneInfo{Err: status.Error(codes.Unavailable, "bench")}
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			ret, err := picker.Pick(infos[i%len(infos)])
+			if err != nil {
+				b.Fatal(err)
+			}
+			if ret.Done != nil {
+				if failEvery > 0 && i%failEvery == 0 {
+					ret.Done(failed)
+				} else {
+					ret.Done(balancer.DoneInfo{})
+				}
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkPickParallel picks from every policy on all Ps at once and
+// finishes each pick like a successful call. The old pickers of the policies
+// in baselinePickers run as <policy>/<n>/old.
+func BenchmarkPickParallel(b *testing.B) {
+	policies := []struct {
+		name    string
+		builder balancer.Builder
+	}{
+		{RoundRobin, newRoundRobinBuilder()},
+		{Random, newRandomBuilder()},
+		{LeastConnection, newLeastConnectionBuilder()},
+		{PeakEwma, newPeakEwmaBuilder()},
+		{WeightedLoad, newWeightedLoadBuilder(DefaultWeightedLoadConfig)},
+		{ConsistentHash, NewConsistentHashBuilder(ConsistentHash, DefaultConsistentHashKey)},
+		{Maglev, NewMaglevBuilder(Maglev, DefaultConsistentHashKey)},
+		{RendezvousHash, NewRendezvousBuilder(RendezvousHash, DefaultConsistentHashKey)},
+		{VersionSplit, newVersionSplitBuilder(VersionSplitConfig{Percents: map[string]int{"": 100}})},
+		{Router, newRouterBuilder(NewRouteTable())},
+	}
+	for _, policy := range policies {
+		for _, n := range []int{10, 100} {
+			picker := benchPickerBuilder(policy.builder).Build(benchBuildInfo(n))
+			b.Run(fmt.Sprintf("%s/%d", policy.name, n), func(b *testing.B) {
+				benchPickParallel(b, picker, 0)
+			})
+			if newOld, ok := baselinePickers[policy.name]; ok {
+				old := newOld(benchBuildInfo(n))
+				b.Run(fmt.Sprintf("%s/%d/old", policy.name, n), func(b *testing.B) {
+					benchPickParallel(b, old, 0)
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkRoundRobinPenalized picks from round robin while some calls fail,
+// so that nodes keep losing and regaining weight, and while all nodes warm up.
+// The old picker runs as <case>/<n>/old.
+func BenchmarkRoundRobinPenalized(b *testing.B) {
+	warming := func() *slowStart {
+		return &slowStart{
+			config:     SlowStartConfig{Window: time.Hour}.withDefaults(),
+			readySince: make(map[balancer.SubConn]time.Time),
+		}
+	}
+	for _, n := range []int{10, 100} {
+		failing := benchPickerBuilder(newRoundRobinBuilder()).Build(benchBuildInfo(n))
+		b.Run(fmt.Sprintf("failing/%d", n), func(b *testing.B) {
+			benchPickParallel(b, failing, 100)
+		})
+		failingOld := newLockedRoundRobinPicker(benchBuildInfo(n), nil)
+		b.Run(fmt.Sprintf("failing/%d/old", n), func(b *testing.B) {
+			benchPickParallel(b, failingOld, 100)
+		})
+		warm := (&roundRobinPickerBuilder{slowStart: warming()}).Build(benchBuildInfo(n))
+		b.Run(fmt.Sprintf("warming/%d", n), func(b *testing.B) {
+			benchPickParallel(b, warm, 0)
+		})
+		warmOld := newLockedRoundRobinPicker(benchBuildInfo(n), warming())
+		b.Run(fmt.Sprintf("warming/%d/old", n), func(b *testing.B) {
+			benchPickParallel(b, warmOld, 0)
+		})
+	}
+}
+
+// BenchmarkSubsetAddresses selects a subset of a large fleet, as on every
+// resolver update.
+func BenchmarkSubsetAddresses(b *testing.B) {
+	for _, n := range []int{1000, 5000} {
+		addrs := testAddresses(n)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				subsetAddresses(addrs, "client", DefaultSubsetSize)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const CircuitBreaker = "circuit_breaker_x"
+
+// CircuitBreakerConfig configures the circuit breaker wrapper. Zero values are
+// replaced by the defaults.
+type CircuitBreakerConfig struct {
+	// Window is the length of the sliding window the error and slow call
+	// rates are computed over, divided into Buckets buckets.
+	Window  time.Duration
+	Buckets int
+	// MinRequests is the number of requests in the window below which the
+	// circuit of a SubConn stays closed.
+	MinRequests int
+	// FailureRateThreshold opens the circuit when the rate of failed
+	// requests in the window reaches it.
+	FailureRateThreshold float64
+	// SlowCallThreshold is the latency above which a request is slow. The
+	// slow call rate is not checked when it is zero.
+	SlowCallThreshold time.Duration
+	// SlowCallRateThreshold opens the circuit when the rate of slow requests
+	// in the window reaches it.
+	SlowCallRateThreshold float64
+	// OpenDuration is how long an open circuit waits before half-opening.
+	OpenDuration time.Duration
+	// HalfOpenProbes is the number of probe requests sent to a half-open
+	// SubConn. The circuit closes when they all succeed.
+	HalfOpenProbes int
+}
+
+var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
+	Window:                10 * time.Second,
+	Buckets:               10,
+	MinRequests:           20,
+	FailureRateThreshold:  0.5,
+	SlowCallRateThreshold: 0.5,
+	OpenDuration:          30 * time.Second,
+	HalfOpenProbes:        3,
+}
+
+func (c CircuitBreakerConfig) withDefaults() CircuitBreakerConfig {
+	d := DefaultCircuitBreakerConfig
+	if c.Window <= 0 {
+		c.Window = d.Window
+	}
+	if c.Buckets <= 0 {
+		c.Buckets = d.Buckets
+	}
+	if c.MinRequests <= 0 {
+		c.MinRequests = d.MinRequests
+	}
+	if c.FailureRateThreshold <= 0 {
+		c.FailureRateThreshold = d.FailureRateThreshold
+	}
+	if c.SlowCallRateThreshold <= 0 {
+		c.SlowCallRateThreshold = d.SlowCallRateThreshold
+	}
+	if c.OpenDuration <= 0 {
+		c.OpenDuration = d.OpenDuration
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = d.HalfOpenProbes
+	}
+	return c
+}
+
+// CircuitBreakerName returns the name the circuit breaker wrapper of the child
+// balancer is registered under.
+func CircuitBreakerName(child string) string {
+	return CircuitBreaker + "_" + child
+}
+
+// InitCircuitBreakerBuilder registers a balancer named
+// CircuitBreakerName(child) that wraps the child balancer with a circuit
+// breaker per SubConn.
+func InitCircuitBreakerBuilder(child string, config CircuitBreakerConfig) {
+	balancer.Register(newCircuitBreakerBuilder(child, config))
+}
+
+// newCircuitBreakerBuilder creates a new circuit breaker balancer builder.
+func newCircuitBreakerBuilder(child string, config CircuitBreakerConfig) balancer.Builder {
+	config = config.withDefaults()
+	return &wrapperBuilder{
+		name:  CircuitBreakerName(child),
+		child: child,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return newCircuitBreaker(b, config)
+		},
+	}
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+type breakerBucket struct {
+	index    int64
+	requests int
+	failures int
+	slow     int
+}
+
+type breakerHost struct {
+	sc      balancer.SubConn
+	ready   bool
+	state   circuitState
+	buckets []breakerBucket
+
+	openedAt time.Time
+	probes   int // probes sent while half-open
+	passed   int // probes succeeded while half-open
+}
+
+type circuitBreaker struct {
+	b      *wrapperBalancer
+	config CircuitBreakerConfig
+	width  int64 // bucket width in nanoseconds
+
+	mu    sync.Mutex
+	hosts map[balancer.SubConn]*breakerHost
+	// candidates is updated under mu whenever a host changes state, so that
+	// the picker only takes mu to send a probe.
+	candidates atomic.Value // *probeCandidates
+}
+
+// probeCandidates is a snapshot of the hosts that may receive a probe.
+type probeCandidates struct {
+	// hosts are half-open and ready with probes left to send
+	hosts []*breakerHost
+	// openUntil is the unix nanoseconds at which the first open host turns
+	// half-open, math.MaxInt64 if no host is open
+	openUntil int64
+}
+
+func newCircuitBreaker(b *wrapperBalancer, config CircuitBreakerConfig) *circuitBreaker {
+	width := int64(config.Window) / int64(config.Buckets)
+	if width <= 0 {
+		width = 1
+	}
+	c := &circuitBreaker{
+		b:      b,
+		config: config,
+		width:  width,
+		hosts:  make(map[balancer.SubConn]*breakerHost),
+	}
+	c.candidates.Store(&probeCandidates{openUntil: math.MaxInt64})
+	return c
+}
+
+func (c *circuitBreaker) addSubConn(sc balancer.SubConn) {
+	c.mu.Lock()
+	c.hosts[sc] = &breakerHost{
+		sc:      sc,
+		buckets: make([]breakerBucket, c.config.Buckets),
+	}
+	c.mu.Unlock()
+}
+
+func (c *circuitBreaker) removeSubConn(sc balancer.SubConn) {
+	c.mu.Lock()
+	if host, ok := c.hosts[sc]; ok {
+		delete(c.hosts, sc)
+		if host.state != circuitClosed {
+			c.updateCandidatesLocked()
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *circuitBreaker) updateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	c.mu.Lock()
+	if host, ok := c.hosts[sc]; ok {
+		host.ready = state.ConnectivityState == connectivity.Ready
+		if host.state != circuitClosed {
+			c.updateCandidatesLocked()
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *circuitBreaker) wrapPicker(picker balancer.Picker) balancer.Picker {
+	return &circuitBreakerPicker{picker: picker, c: c}
+}
+
+func (c *circuitBreaker) close() {
+}
+
+// record adds the result of a request sent by the child picker to the window
+// of the host and opens its circuit when a threshold is reached. Canceled
+// requests are left out.
+func (c *circuitBreaker) record(sc balancer.SubConn, err error, latency time.Duration) {
+	if isCanceled(err) {
+		return
+	}
+	now := time.Now()
+	failed := isServerFailure(err)
+	slow := c.config.SlowCallThreshold > 0 && latency > c.config.SlowCallThreshold
+
+	c.mu.Lock()
+	host, ok := c.hosts[sc]
+	if !ok || host.state != circuitClosed {
+		c.mu.Unlock()
+		return
+	}
+	index := now.UnixNano() / c.width
+	bucket := &host.buckets[index%int64(len(host.buckets))]
+	if bucket.index != index {
+		*bucket = breakerBucket{index: index}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+	if slow {
+		bucket.slow++
+	}
+
+	var requests, failures, slows int
+	for _, b := range host.buckets {
+		if b.index > index-int64(len(host.buckets)) {
+			requests += b.requests
+			failures += b.failures
+			slows += b.slow
+		}
+	}
+	open := false
+	if requests >= c.config.MinRequests {
+		if float64(failures)/float64(requests) >= c.config.FailureRateThreshold {
+			open = true
+		}
+		if c.config.SlowCallThreshold > 0 && float64(slows)/float64(requests) >= c.config.SlowCallRateThreshold {
+			open = true
+		}
+	}
+	if open {
+		c.openLocked(host, now)
+	}
+	c.mu.Unlock()
+
+	if open {
+		c.b.hide(sc)
+	}
+}
+
+func (c *circuitBreaker) openLocked(host *breakerHost, now time.Time) {
+	host.state = circuitOpen
+	host.openedAt = now
+	host.probes = 0
+	host.passed = 0
+	c.updateCandidatesLocked()
+}
+
+// updateCandidatesLocked stores a new snapshot of the probe candidates. c.mu
+// must be held.
+func (c *circuitBreaker) updateCandidatesLocked() *probeCandidates {
+	candidates := &probeCandidates{openUntil: math.MaxInt64}
+	for _, host := range c.hosts {
+		switch host.state {
+		case circuitOpen:
+			if until := host.openedAt.Add(c.config.OpenDuration).UnixNano(); until < candidates.openUntil {
+				candidates.openUntil = until
+			}
+		case circuitHalfOpen:
+			if host.ready && host.probes < c.config.HalfOpenProbes {
+				candidates.hosts = append(candidates.hosts, host)
+			}
+		}
+	}
+	c.candidates.Store(candidates)
+	return candidates
+}
+
+// probe returns a half-open host that may receive a probe request, moving
+// open hosts whose open duration is over to half-open. It only takes c.mu
+// when the candidates say there is a probe to send or a host to move.
+func (c *circuitBreaker) probe() *breakerHost {
+	now := time.Now()
+	candidates := c.candidates.Load().(*probeCandidates)
+	if len(candidates.hosts) == 0 && now.UnixNano() < candidates.openUntil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	candidates = c.candidates.Load().(*probeCandidates)
+	if now.UnixNano() >= candidates.openUntil {
+		for _, host := range c.hosts {
+			if host.state == circuitOpen && now.Sub(host.openedAt) >= c.config.OpenDuration {
+				host.state = circuitHalfOpen
+			}
+		}
+		candidates = c.updateCandidatesLocked()
+	}
+	if len(candidates.hosts) == 0 {
+		return nil
+	}
+	host := candidates.hosts[0]
+	host.probes++
+	if host.probes >= c.config.HalfOpenProbes {
+		c.updateCandidatesLocked()
+	}
+	return host
+}
+
+// recordProbe closes the circuit of host when all its probes succeeded and
+// opens it again on the first failed one. A dropped or canceled probe gives
+// its slot back.
+func (c *circuitBreaker) recordProbe(host *breakerHost, err error, latency time.Duration) {
+	failed := isServerFailure(err) || c.config.SlowCallThreshold > 0 && latency > c.config.SlowCallThreshold
+
+	c.mu.Lock()
+	if _, ok := c.hosts[host.sc]; !ok || host.state != circuitHalfOpen {
+		c.mu.Unlock()
+		return
+	}
+	if isDroppedPick(err) || isCanceled(err) {
+		host.probes--
+		c.updateCandidatesLocked()
+		c.mu.Unlock()
+		return
+	}
+	closed := false
+	if failed {
+		c.openLocked(host, time.Now())
+	} else {
+		host.passed++
+		if host.passed >= c.config.HalfOpenProbes {
+			host.state = circuitClosed
+			for i := range host.buckets {
+				host.buckets[i] = breakerBucket{}
+			}
+			c.updateCandidatesLocked()
+			closed = true
+		}
+	}
+	c.mu.Unlock()
+
+	if closed {
+		c.b.show(host.sc)
+	}
+}
+
+// circuitBreakerPicker sends the probes of half-open hosts, which are hidden
+// from the child, and every other request through the child picker.
+type circuitBreakerPicker struct {
+	picker balancer.Picker
+	c      *circuitBreaker
+}
+
+func (p *circuitBreakerPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	start := time.Now()
+	if host := p.c.probe(); host != nil {
+		ret := balancer.PickResult{SubConn: host.sc}
+		ret.Done = func(info balancer.DoneInfo) {
+			p.c.recordProbe(host, info.Err, time.Since(start))
+		}
+		return ret, nil
+	}
+
+	ret, err := p.picker.Pick(info)
+	if err != nil || ret.SubConn == nil {
+		return ret, err
+	}
+	return p.track(ret, start), nil
+}
+
+func (p *circuitBreakerPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return p.track(pickSubConn(p.picker, info, sc), time.Now()), true
+}
+
+// track wraps Done to record the result of the request.
+func (p *circuitBreakerPicker) track(ret balancer.PickResult, start time.Time) balancer.PickResult {
+	sc := ret.SubConn
+	done := ret.Done
+	ret.Done = func(info balancer.DoneInfo) {
+		if !isDroppedPick(info.Err) {
+			p.c.record(sc, info.Err, time.Since(start))
+		}
+		if done != nil {
+			done(info)
+		}
+	}
+	return ret
+}
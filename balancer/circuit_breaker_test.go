@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	config := CircuitBreakerConfig{
+		MinRequests:    4,
+		OpenDuration:   time.Minute,
+		HalfOpenProbes: 2,
+	}
+	cc, b := newTestWrapper(t, newCircuitBreakerBuilder(RoundRobin, config), 3)
+	defer b.Close()
+	c := b.wrapper.(*circuitBreaker)
+	sc := cc.subConns[0]
+	host := c.hosts[sc]
+	state := func() circuitState {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return host.state
+	}
+	// halfOpen lets the open duration of host pass
+	halfOpen := func() {
+		c.mu.Lock()
+		host.openedAt = time.Now().Add(-config.OpenDuration)
+		c.updateCandidatesLocked()
+		c.mu.Unlock()
+	}
+	// probes picks until the first pick that is not a probe of host
+	probes := func() []balancer.PickResult {
+		var ret []balancer.PickResult
+		for {
+			pick, err := cc.pick(context.Background())
+			if err != nil {
+				t.Fatalf("pick: %v", err)
+			}
+			if pick.SubConn != sc {
+				return ret
+			}
+			ret = append(ret, pick)
+		}
+	}
+
+	// closed: the circuit opens once half of the requests failed
+	for i := 0; i < 3; i++ {
+		c.record(sc, nil, 0)
+	}
+	for i := 0; i < 2; i++ {
+		c.record(sc, errTestUnavailable, 0)
+		if got := state(); got != circuitClosed {
+			t.Fatalf("circuit %v below the failure rate, want closed", got)
+		}
+	}
+	c.record(sc, errTestUnavailable, 0)
+	if got := state(); got != circuitOpen {
+		t.Fatalf("circuit %v at the failure rate, want open", got)
+	}
+	if picked := cc.picked(t, 20); picked[sc] != 0 {
+		t.Fatalf("picks with an open circuit = %v", picked)
+	}
+	// picks only look at the probe candidates while no probe is due
+	c.mu.Lock()
+	picked := make(chan error)
+	go func() {
+		_, err := cc.pick(context.Background())
+		picked <- err
+	}()
+	select {
+	case <-picked:
+		c.mu.Unlock()
+	case <-time.After(time.Second):
+		t.Fatal("pick with an open circuit waits for the circuit breaker lock")
+	}
+
+	// half-open: probes go to host, a failed one opens the circuit again
+	halfOpen()
+	picks := probes()
+	if len(picks) != config.HalfOpenProbes || state() != circuitHalfOpen {
+		t.Fatalf("%d probes sent to a %v circuit, want %d to a half-open one", len(picks), state(), config.HalfOpenProbes)
+	}
+	picks[0].Done(balancer.DoneInfo{})
+	picks[1].Done(balancer.DoneInfo{Err: errTestUnavailable})
+	if got := state(); got != circuitOpen {
+		t.Fatalf("circuit %v after a failed probe, want open", got)
+	}
+	if picks := probes(); len(picks) != 0 {
+		t.Fatalf("%d probes sent right after the circuit opened again", len(picks))
+	}
+
+	// a dropped probe gives its slot back
+	halfOpen()
+	picks = probes()
+	picks[0].Done(balancer.DoneInfo{Err: errPickExcluded})
+	if more := probes(); len(more) != 1 {
+		t.Fatalf("%d probes sent after a dropped probe, want 1", len(more))
+	} else {
+		picks = append(picks[1:], more...)
+	}
+
+	// the circuit closes when all probes succeeded
+	for _, pick := range picks {
+		pick.Done(balancer.DoneInfo{})
+	}
+	if got := state(); got != circuitClosed {
+		t.Fatalf("circuit %v after the probes succeeded, want closed", got)
+	}
+	if candidates := c.candidates.Load().(*probeCandidates); len(candidates.hosts) != 0 || candidates.openUntil != math.MaxInt64 {
+		t.Fatalf("probe candidates %+v after closing, want none", candidates)
+	}
+	if picked := cc.picked(t, 30); picked[sc] != 10 {
+		t.Fatalf("picks after the circuit closed = %v", picked)
+	}
+	// the window starts over
+	c.record(sc, errTestUnavailable, 0)
+	if got := state(); got != circuitClosed {
+		t.Fatalf("circuit %v after one failure, want closed", got)
+	}
+}
+
+func TestCircuitBreakerCanceled(t *testing.T) {
+	config := CircuitBreakerConfig{
+		MinRequests:    4,
+		OpenDuration:   time.Minute,
+		HalfOpenProbes: 1,
+	}
+	cc, b := newTestWrapper(t, newCircuitBreakerBuilder(RoundRobin, config), 3)
+	defer b.Close()
+	c := b.wrapper.(*circuitBreaker)
+	sc := cc.subConns[0]
+	host := c.hosts[sc]
+
+	// canceled calls stay out of the failure rate
+	c.record(sc, nil, 0)
+	for i := 0; i < 10; i++ {
+		c.record(sc, errTestCanceled, 0)
+	}
+	for i := 0; i < 3; i++ {
+		c.record(sc, errTestUnavailable, 0)
+	}
+	c.mu.Lock()
+	state := host.state
+	host.openedAt = time.Now().Add(-config.OpenDuration)
+	c.updateCandidatesLocked()
+	c.mu.Unlock()
+	if state != circuitOpen {
+		t.Fatalf("circuit %v after 3 of 4 calls failed around canceled ones, want open", state)
+	}
+
+	// a canceled probe neither closes nor opens the circuit
+	pick, err := cc.pick(context.Background())
+	if err != nil || pick.SubConn != sc {
+		t.Fatalf("probe went to %v, %v", pick.SubConn, err)
+	}
+	pick.Done(balancer.DoneInfo{Err: errTestCanceled})
+	c.mu.Lock()
+	state, probes := host.state, host.probes
+	c.mu.Unlock()
+	if state != circuitHalfOpen || probes != 0 {
+		t.Fatalf("circuit %v with %d probes after a canceled probe, want half-open with 0", state, probes)
+	}
+}
@@ -0,0 +1,304 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const ConcurrencyLimit = "concurrency_limit_x"
+
+// ConcurrencyLimitConfig configures the concurrency limit wrapper. Zero
+// values are replaced by the defaults.
+type ConcurrencyLimitConfig struct {
+	// InitialLimit is the limit of a new SubConn, it stays between MinLimit
+	// and MaxLimit.
+	InitialLimit float64
+	MinLimit     float64
+	MaxLimit     float64
+	// Tolerance is how much the latency of a request may exceed the long term
+	// latency of its SubConn before the limit shrinks.
+	Tolerance float64
+	// Smoothing is the weight of every new limit in the limit, between 0
+	// and 1.
+	Smoothing float64
+	// Backoff multiplies the limit when a request fails.
+	Backoff float64
+	// Reject fails the picks with ResourceExhausted when all SubConns are at
+	// their limit. By default they wait until a request completes.
+	Reject bool
+}
+
+var DefaultConcurrencyLimitConfig = ConcurrencyLimitConfig{
+	InitialLimit: 20,
+	MinLimit:     1,
+	MaxLimit:     1000,
+	Tolerance:    1.5,
+	Smoothing:    0.2,
+	Backoff:      0.9,
+}
+
+// longRTTWindow is the number of requests the long term latency averages.
+const longRTTWindow = 600
+
+// maxLimitedPicks is how often the child picker is asked again when it picks
+// a SubConn at its limit, before the SubConn with most room is chosen.
+const maxLimitedPicks = 3
+
+var (
+	errPickLimited = status.Error(codes.Canceled, "grpclb: SubConn is at its concurrency limit")
+	errAllLimited  = status.Error(codes.ResourceExhausted, "grpclb: all SubConns are at their concurrency limit")
+)
+
+func (c ConcurrencyLimitConfig) withDefaults() ConcurrencyLimitConfig {
+	d := DefaultConcurrencyLimitConfig
+	if c.MinLimit <= 0 {
+		c.MinLimit = d.MinLimit
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = d.MaxLimit
+	}
+	if c.InitialLimit <= 0 {
+		c.InitialLimit = d.InitialLimit
+	}
+	c.InitialLimit = math.Max(c.MinLimit, math.Min(c.MaxLimit, c.InitialLimit))
+	if c.Tolerance < 1 {
+		c.Tolerance = d.Tolerance
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = d.Smoothing
+	}
+	if c.Backoff <= 0 || c.Backoff >= 1 {
+		c.Backoff = d.Backoff
+	}
+	return c
+}
+
+// ConcurrencyLimitName returns the name the concurrency limit wrapper of the
+// child balancer is registered under.
+func ConcurrencyLimitName(child string) string {
+	return ConcurrencyLimit + "_" + child
+}
+
+// InitConcurrencyLimitBuilder registers a balancer named
+// ConcurrencyLimitName(child) that wraps the child balancer and limits the
+// in-flight requests of every SubConn. The limit grows while the latency stays
+// near its long term average and shrinks when it rises or requests fail.
+func InitConcurrencyLimitBuilder(child string, config ConcurrencyLimitConfig) {
+	balancer.Register(newConcurrencyLimitBuilder(child, config))
+}
+
+// newConcurrencyLimitBuilder creates a new concurrency limit balancer builder.
+func newConcurrencyLimitBuilder(child string, config ConcurrencyLimitConfig) balancer.Builder {
+	config = config.withDefaults()
+	return &wrapperBuilder{
+		name:  ConcurrencyLimitName(child),
+		child: child,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return &concurrencyLimiter{
+				b:      b,
+				config: config,
+				nodes:  make(map[balancer.SubConn]*limitNode),
+			}
+		},
+	}
+}
+
+// limitNode adds a concurrency limit to the in-flight count of Node.
+type limitNode struct {
+	Node
+	max int64 // the limit rounded down, read without mu
+
+	mu      sync.Mutex
+	limit   float64
+	longRTT float64
+}
+
+// acquire counts a new request and reports whether it is within the limit.
+func (n *limitNode) acquire() bool {
+	for {
+		inflight := atomic.LoadInt64(&n.inflight)
+		if inflight >= atomic.LoadInt64(&n.max) {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&n.inflight, inflight, inflight+1) {
+			return true
+		}
+	}
+}
+
+// update adjusts the limit to a completed request, which found inflight
+// requests in flight when it was picked.
+func (n *limitNode) update(config *ConcurrencyLimitConfig, inflight int64, rtt time.Duration, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	limit := n.limit
+	if isServerFailure(err) {
+		limit *= config.Backoff
+	} else if err == nil {
+		sample := float64(rtt)
+		if n.longRTT == 0 {
+			n.longRTT = sample
+		} else {
+			n.longRTT += (sample - n.longRTT) / longRTTWindow
+		}
+		// a SubConn far below its limit says nothing about a higher one
+		if float64(inflight)*2 < limit && sample <= n.longRTT*config.Tolerance {
+			return
+		}
+		gradient := math.Max(0.5, math.Min(1, config.Tolerance*n.longRTT/sample))
+		newLimit := limit*gradient + math.Sqrt(limit)
+		limit = limit*(1-config.Smoothing) + newLimit*config.Smoothing
+	}
+	n.limit = math.Max(config.MinLimit, math.Min(config.MaxLimit, limit))
+	atomic.StoreInt64(&n.max, int64(n.limit))
+}
+
+// room is the number of requests the node accepts before its limit.
+func (n *limitNode) room() int64 {
+	return atomic.LoadInt64(&n.max) - atomic.LoadInt64(&n.inflight)
+}
+
+type concurrencyLimiter struct {
+	b      *wrapperBalancer
+	config ConcurrencyLimitConfig
+
+	// nodes is guarded by b.mu, the wrapper methods are called with it held
+	nodes map[balancer.SubConn]*limitNode
+	// waiting is set when a pick found all SubConns at their limit
+	waiting int32
+}
+
+func (l *concurrencyLimiter) addSubConn(sc balancer.SubConn) {
+	n := &limitNode{Node: Node{SubConn: sc}, limit: l.config.InitialLimit}
+	n.max = int64(n.limit)
+	l.nodes[sc] = n
+}
+
+func (l *concurrencyLimiter) removeSubConn(sc balancer.SubConn) {
+	delete(l.nodes, sc)
+}
+
+func (l *concurrencyLimiter) updateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+}
+
+func (l *concurrencyLimiter) wrapPicker(picker balancer.Picker) balancer.Picker {
+	p := &concurrencyLimitPicker{
+		picker: picker,
+		l:      l,
+		nodes:  make(map[balancer.SubConn]*limitNode, len(l.nodes)),
+	}
+	for sc, n := range l.nodes {
+		p.nodes[sc] = n
+	}
+	for _, sc := range l.b.ready() {
+		if n, ok := l.nodes[sc]; ok {
+			p.ready = append(p.ready, n)
+		}
+	}
+	return p
+}
+
+func (l *concurrencyLimiter) close() {
+}
+
+// release ends a request and wakes the waiting picks up.
+func (l *concurrencyLimiter) release(n *limitNode) {
+	atomic.AddInt64(&n.inflight, -1)
+	if atomic.CompareAndSwapInt32(&l.waiting, 1, 0) {
+		go l.b.updatePicker()
+	}
+}
+
+type concurrencyLimitPicker struct {
+	picker balancer.Picker
+	l      *concurrencyLimiter
+	nodes  map[balancer.SubConn]*limitNode
+	ready  []*limitNode
+}
+
+func (p *concurrencyLimitPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	for i := 0; i < maxLimitedPicks; i++ {
+		ret, err := p.picker.Pick(info)
+		if err != nil || ret.SubConn == nil {
+			return ret, err
+		}
+		n, ok := p.nodes[ret.SubConn]
+		if !ok {
+			return ret, nil
+		}
+		if n.acquire() {
+			return p.track(n, ret), nil
+		}
+		if ret.Done != nil {
+			ret.Done(balancer.DoneInfo{Err: errPickLimited})
+		}
+	}
+
+	// the child keeps picking SubConns at their limit, take the one with most
+	// room left
+	if n := p.acquireRoom(); n != nil {
+		return p.track(n, pickSubConn(p.picker, info, n.SubConn)), nil
+	}
+	if p.l.config.Reject {
+		return balancer.PickResult{}, errAllLimited
+	}
+	atomic.StoreInt32(&p.l.waiting, 1)
+	// a request may have completed before waiting was set
+	if n := p.acquireRoom(); n != nil {
+		return p.track(n, pickSubConn(p.picker, info, n.SubConn)), nil
+	}
+	return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+}
+
+func (p *concurrencyLimitPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	ret := pickSubConn(p.picker, info, sc)
+	n, ok := p.nodes[sc]
+	if !ok {
+		return ret, true
+	}
+	// the caller needs this SubConn, so it is counted even above its limit
+	if !n.acquire() {
+		atomic.AddInt64(&n.inflight, 1)
+	}
+	return p.track(n, ret), true
+}
+
+// acquireRoom acquires the ready node with most room, or returns nil if all
+// are at their limit.
+func (p *concurrencyLimitPicker) acquireRoom() *limitNode {
+	for {
+		var best *limitNode
+		for _, n := range p.ready {
+			if n.room() > 0 && (best == nil || n.room() > best.room()) {
+				best = n
+			}
+		}
+		if best == nil || best.acquire() {
+			return best
+		}
+	}
+}
+
+// track wraps Done to release the node and update its limit. A dropped pick
+// only releases it.
+func (p *concurrencyLimitPicker) track(n *limitNode, ret balancer.PickResult) balancer.PickResult {
+	inflight := atomic.LoadInt64(&n.inflight)
+	start := time.Now()
+	done := ret.Done
+	ret.Done = func(info balancer.DoneInfo) {
+		if !isDroppedPick(info.Err) {
+			n.update(&p.l.config, inflight, time.Since(start), info.Err)
+		}
+		p.l.release(n)
+		if done != nil {
+			done(info)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,163 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// duration is a time.Duration written as a string like "30s" in the service
+// config.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// parseLBConfig unmarshals the service config of a policy into config.
+func parseLBConfig(name string, js json.RawMessage, config serviceconfig.LoadBalancingConfig) (serviceconfig.LoadBalancingConfig, error) {
+	if err := json.Unmarshal(js, config); err != nil {
+		return nil, fmt.Errorf("grpclb: invalid %s config %s: %v", name, js, err)
+	}
+	return config, nil
+}
+
+// WithBalancer returns a DialOption that makes the ClientConn use the balancer
+// registered as name through its default service config. Like any balancer,
+// it must be registered with balancer.Register in an init function.
+func WithBalancer(name string) grpc.DialOption {
+	return grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{%q: {}}]}`, name))
+}
+
+// configBuilder builds a base balancer whose picker builder is created from
+// the service config of its ClientConn, e.g.
+//
+//	{"loadBalancingConfig": [{"least_connection_x": {"choice_count": 3}}]}
+//
+// so that two ClientConns in one process can use different settings.
+// newPickerBuilder gets a nil config until the ClientConn has one.
+type configBuilder struct {
+	name             string
+	parseConfig      func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error)
+	newPickerBuilder func(config serviceconfig.LoadBalancingConfig) base.PickerBuilder
+}
+
+func (bb *configBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	pb := &configPickerBuilder{
+		name:             bb.name,
+		newPickerBuilder: bb.newPickerBuilder,
+		builder:          bb.newPickerBuilder(nil),
+	}
+	pb.rebuildingPickerBuilder = &rebuildingPickerBuilder{
+		newPicker: func(buildInfo base.PickerBuildInfo) balancer.Picker {
+			return pb.builder.Build(buildInfo)
+		},
+	}
+	return &configBalancer{
+		Balancer: base.NewBalancerBuilder(bb.name, pb, base.Config{HealthCheck: true}).Build(cc, opts),
+		pb:       pb,
+	}
+}
+
+func (bb *configBuilder) Name() string {
+	return bb.name
+}
+
+func (bb *configBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return bb.parseConfig(js)
+}
+
+type configBalancer struct {
+	balancer.Balancer
+	pb *configPickerBuilder
+}
+
+func (b *configBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if s.BalancerConfig != nil {
+		b.pb.updateConfig(s.BalancerConfig)
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// configPickerBuilder replaces its picker builder when the config changes,
+// and the last picker with one from the new builder. Build and updateConfig
+// are both called from the balancer goroutine.
+type configPickerBuilder struct {
+	*rebuildingPickerBuilder
+	name             string
+	newPickerBuilder func(config serviceconfig.LoadBalancingConfig) base.PickerBuilder
+
+	config  serviceconfig.LoadBalancingConfig
+	builder base.PickerBuilder
+}
+
+func (b *configPickerBuilder) updateConfig(config serviceconfig.LoadBalancingConfig) {
+	if reflect.DeepEqual(config, b.config) {
+		return
+	}
+	grpclog.Infof("%s: new config %+v", b.name, config)
+	b.config = config
+	b.builder = b.newPickerBuilder(config)
+	b.rebuild()
+}
+
+// rebuildingPickerBuilder builds its pickers with newPicker and keeps the
+// last one, which rebuild replaces in place. base only builds a new picker
+// when a SubConn changes state, so a balancer whose pickers also depend on
+// its config or the resolved addresses rebuilds when they change. Build and
+// rebuild are both called from the balancer goroutine.
+type rebuildingPickerBuilder struct {
+	newPicker func(buildInfo base.PickerBuildInfo) balancer.Picker
+	buildInfo base.PickerBuildInfo
+	picker    *configPicker
+}
+
+func (b *rebuildingPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	b.buildInfo = buildInfo
+	b.picker = &configPicker{}
+	b.picker.store(b.newPicker(buildInfo))
+	return b.picker
+}
+
+func (b *rebuildingPickerBuilder) rebuild() {
+	if b.picker != nil {
+		b.picker.store(b.newPicker(b.buildInfo))
+	}
+}
+
+type configPicker struct {
+	picker atomic.Value // pickerValue
+}
+
+// pickerValue gives the pickers stored in configPicker one concrete type.
+type pickerValue struct {
+	balancer.Picker
+}
+
+func (p *configPicker) store(picker balancer.Picker) {
+	p.picker.Store(pickerValue{picker})
+}
+
+func (p *configPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	return p.picker.Load().(pickerValue).Pick(info)
+}
+
+func (p *configPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return trySubConn(p.picker.Load().(pickerValue).Picker, info, sc)
+}
@@ -0,0 +1,95 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/resolver"
+	"testing"
+	"time"
+)
+
+// configuredPicker returns the picker the last configPicker of cc holds.
+func (cc *testClientConn) configuredPicker() balancer.Picker {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.picker.(*configPicker).picker.Load().(pickerValue).Picker
+}
+
+func TestServiceConfig(t *testing.T) {
+	hashKey := balancer.PickInfo{Ctx: context.WithValue(context.Background(), "user-id", "u1")}
+	noKey := balancer.PickInfo{Ctx: context.Background()}
+	tests := []struct {
+		name string
+		bb   balancer.Builder
+		js   string
+		// configured tells if picker uses the setting of js
+		configured func(picker balancer.Picker) bool
+	}{
+		{
+			name: "hash_key",
+			bb:   NewConsistentHashBuilder(ConsistentHash, DefaultConsistentHashKey),
+			js:   `{"hash_key": "user-id"}`,
+			configured: func(picker balancer.Picker) bool {
+				_, ok := picker.(*consistentHashPicker).keyExtractor(hashKey)
+				return ok
+			},
+		},
+		{
+			name: "fallback",
+			bb:   NewConsistentHashBuilder(ConsistentHash, DefaultConsistentHashKey),
+			js:   `{"fallback": "fail"}`,
+			configured: func(picker balancer.Picker) bool {
+				_, err := picker.Pick(noKey)
+				return err == errMissingHashKey
+			},
+		},
+		{
+			name: "slow_start",
+			bb:   newRoundRobinBuilder(),
+			js:   `{"slow_start": {"window": "30s"}}`,
+			configured: func(picker balancer.Picker) bool {
+				s := picker.(*roundRobinPicker).slowStart
+				return s != nil && s.config.Window == 30*time.Second
+			},
+		},
+		{
+			name: "choice_count",
+			bb:   newLeastConnectionBuilder(),
+			js:   `{"choice_count": 3}`,
+			configured: func(picker balancer.Picker) bool {
+				return picker.(*leastConnectionPicker).choices == 3
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// two ClientConns of one builder, only one has the setting
+			cc, b := newTestBalancer(t, test.bb, test.js, 3)
+			defer b.Close()
+			other, otherB := newTestBalancer(t, test.bb, `{}`, 3)
+			defer otherB.Close()
+			if !test.configured(cc.configuredPicker()) {
+				t.Fatalf("picker of %s does not use it", test.js)
+			}
+			if test.configured(other.configuredPicker()) {
+				t.Fatalf("picker of another ClientConn uses %s", test.js)
+			}
+
+			// a new config replaces the last picker without SubConn changes
+			config, err := test.bb.(balancer.ConfigParser).ParseConfig(json.RawMessage(test.js))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := otherB.UpdateClientConnState(balancer.ClientConnState{
+				ResolverState:  resolver.State{Addresses: testResolverAddresses(3)},
+				BalancerConfig: config,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !test.configured(other.configuredPicker()) {
+				t.Fatalf("picker does not use %s after a config update", test.js)
+			}
+		})
+	}
+}
@@ -1,71 +1,375 @@
 package balancer
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/liyue201/grpc-lb/common"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+	"math"
+	"sync/atomic"
 )
 
 const ConsistentHash = "consistent_hash_x"
 
 var DefaultConsistentHashKey = "consistent-hash"
 
-func InitConsistentHashBuilder(consistanceHashKey string) {
-	balancer.Register(newConsistentHashBuilder(consistanceHashKey))
+// ConsistentHashOption configures the consistent_hash_x, maglev_x and
+// rendezvous_x balancer builders.
+type ConsistentHashOption func(c *consistentHashConfig)
+
+// WithBoundedLoad enables consistent hashing with bounded loads. The number of
+// in-flight requests of a SubConn is capped at ceil(avg * (1+epsilon)), a key
+// whose owner is full is sent to the next SubConn clockwise on the ring.
+// It only applies to consistent_hash_x.
+func WithBoundedLoad(epsilon float64) ConsistentHashOption {
+	return func(c *consistentHashConfig) {
+		c.epsilon = epsilon
+	}
+}
+
+// WithKeyExtractor replaces the default extraction of the hash key, which
+// reads a string from the RPC context under the key given to the builder.
+func WithKeyExtractor(fn KeyExtractor) ConsistentHashOption {
+	return func(c *consistentHashConfig) {
+		c.keyExtractor = fn
+	}
+}
+
+// WithRingSize makes consistent_hash_x share a ring of about size virtual
+// nodes among the SubConns in proportion to their weights, instead of giving
+// each SubConn the replicas count times its weight.
+func WithRingSize(size int) ConsistentHashOption {
+	return func(c *consistentHashConfig) {
+		c.ringSize = size
+	}
+}
+
+// WithHashFunc sets the hash function of the ring of consistent_hash_x and of
+// the lookup table of maglev_x, e.g. XXHash. rendezvous_x always scores with
+// 64 bit FNV-1a.
+func WithHashFunc(fn HashFunc) ConsistentHashOption {
+	return func(c *consistentHashConfig) {
+		c.hash = fn
+	}
+}
+
+// WithFallback sets how requests without a hash key are picked. The default
+// is FallbackRoundRobin.
+func WithFallback(policy FallbackPolicy) ConsistentHashOption {
+	return func(c *consistentHashConfig) {
+		c.fallback = policy
+	}
+}
+
+type consistentHashConfig struct {
+	keyExtractor KeyExtractor
+	epsilon      float64
+	replicas     int
+	ringSize     int
+	hash         HashFunc
+	fallback     FallbackPolicy
+	fallbacks    *int64
+}
+
+func newConsistentHashConfig(name, consistentHashKey string, opts []ConsistentHashOption) consistentHashConfig {
+	c := consistentHashConfig{
+		keyExtractor: ContextValueKey(consistentHashKey),
+		replicas:     DefaultReplicas,
+		hash:         DefaultHash,
+		fallback:     FallbackRoundRobin,
+		fallbacks:    fallbackCounter(name),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.hash == nil {
+		c.hash = DefaultHash
+	}
+	return c
+}
+
+// hashLBConfig is the service config of consistent_hash_x, maglev_x and
+// rendezvous_x, e.g. {"hash_key": "x-user-id", "key_source": "metadata",
+// "fallback": "random"}. Replicas, RingSize and BoundedLoad only apply to
+// consistent_hash_x, TableSize to maglev_x and HashFunc to both of them.
+// Settings left out keep the values the builder was registered with.
+type hashLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	HashKey string `json:"hash_key,omitempty"`
+	// KeySource is "context" for a string context value under HashKey,
+	// "metadata" for the outgoing header HashKey or "method" for the full
+	// method name. It defaults to "context".
+	KeySource string `json:"key_source,omitempty"`
+	// Fallback is "round_robin", "random" or "fail".
+	Fallback string `json:"fallback,omitempty"`
+	// HashFunc is "fnv", "xxhash", "murmur3" or "crc32".
+	HashFunc    string  `json:"hash_func,omitempty"`
+	Replicas    int     `json:"replicas,omitempty"`
+	RingSize    int     `json:"ring_size,omitempty"`
+	BoundedLoad float64 `json:"bounded_load,omitempty"`
+	TableSize   int     `json:"table_size,omitempty"`
+}
+
+// apply returns c with the settings of the service config.
+func (lbc *hashLBConfig) apply(c consistentHashConfig) (consistentHashConfig, error) {
+	switch lbc.KeySource {
+	case "", "context":
+		if lbc.HashKey != "" {
+			c.keyExtractor = ContextValueKey(lbc.HashKey)
+		} else if lbc.KeySource != "" {
+			return c, fmt.Errorf("hash_key is required for key_source %q", lbc.KeySource)
+		}
+	case "metadata":
+		if lbc.HashKey == "" {
+			return c, fmt.Errorf("hash_key is required for key_source %q", lbc.KeySource)
+		}
+		c.keyExtractor = MetadataKey(lbc.HashKey)
+	case "method":
+		c.keyExtractor = FullMethodKey()
+	default:
+		return c, fmt.Errorf("unknown key_source %q", lbc.KeySource)
+	}
+
+	switch lbc.Fallback {
+	case "":
+	case "round_robin":
+		c.fallback = FallbackRoundRobin
+	case "random":
+		c.fallback = FallbackRandom
+	case "fail":
+		c.fallback = FallbackFail
+	default:
+		return c, fmt.Errorf("unknown fallback %q", lbc.Fallback)
+	}
+
+	if lbc.HashFunc != "" {
+		fn, ok := hashFuncs[lbc.HashFunc]
+		if !ok {
+			return c, fmt.Errorf("unknown hash_func %q", lbc.HashFunc)
+		}
+		c.hash = fn
+	}
+
+	if lbc.Replicas < 0 || lbc.RingSize < 0 || lbc.BoundedLoad < 0 || lbc.TableSize < 0 {
+		return c, fmt.Errorf("negative replicas, ring_size, bounded_load or table_size")
+	}
+	if lbc.Replicas > 0 {
+		c.replicas = lbc.Replicas
+	}
+	if lbc.RingSize > 0 {
+		c.ringSize = lbc.RingSize
+	}
+	if lbc.BoundedLoad > 0 {
+		c.epsilon = lbc.BoundedLoad
+	}
+	return c, nil
+}
+
+// newHashPolicyBuilder creates the builder of a hashing policy registered
+// with config, which the service config of a ClientConn can override.
+func newHashPolicyBuilder(name string, config consistentHashConfig, newPickerBuilder func(c consistentHashConfig, lbc *hashLBConfig) base.PickerBuilder) balancer.Builder {
+	return &configBuilder{
+		name: name,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			lbc := &hashLBConfig{}
+			if _, err := parseLBConfig(name, js, lbc); err != nil {
+				return nil, err
+			}
+			if _, err := lbc.apply(config); err != nil {
+				return nil, fmt.Errorf("grpclb: invalid %s config %s: %v", name, js, err)
+			}
+			if lbc.TableSize > 0 && !isPrime(lbc.TableSize) {
+				return nil, fmt.Errorf("grpclb: invalid %s config %s: table_size must be prime", name, js)
+			}
+			return lbc, nil
+		},
+		newPickerBuilder: func(lbConfig serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			lbc, ok := lbConfig.(*hashLBConfig)
+			if !ok {
+				return newPickerBuilder(config, &hashLBConfig{})
+			}
+			// validated by parseConfig
+			c, _ := lbc.apply(config)
+			return newPickerBuilder(c, lbc)
+		},
+	}
+}
+
+func init() {
+	balancer.Register(NewConsistentHashBuilder(ConsistentHash, DefaultConsistentHashKey))
+}
+
+// InitConsistentHashBuilder registers consistent_hash_x again, reading the
+// hash key from the context value under consistanceHashKey unless an option or
+// the service config says otherwise.
+func InitConsistentHashBuilder(consistanceHashKey string, opts ...ConsistentHashOption) {
+	balancer.Register(NewConsistentHashBuilder(ConsistentHash, consistanceHashKey, opts...))
 }
 
-// newConsistanceHashBuilder creates a new ConsistanceHash balancer builder.
-func newConsistentHashBuilder(consistentHashKey string) balancer.Builder {
-	return base.NewBalancerBuilder(ConsistentHash, &consistentHashPickerBuilder{consistentHashKey}, base.Config{HealthCheck: true})
+// NewConsistentHashBuilder creates a consistent hash balancer builder named
+// name. Builders with different names can be registered side by side, so
+// that each service uses its own hash key and options:
+//
+//	func init() {
+//		balancer.Register(NewConsistentHashBuilder("user_hash", "user-id"))
+//		balancer.Register(NewConsistentHashBuilder("order_hash", "order-id", WithHashFunc(XXHash)))
+//	}
+//
+//	grpc.Dial(target, WithBalancer("order_hash"))
+func NewConsistentHashBuilder(name, consistentHashKey string, opts ...ConsistentHashOption) balancer.Builder {
+	config := newConsistentHashConfig(name, consistentHashKey, opts)
+	return newHashPolicyBuilder(name, config, func(c consistentHashConfig, lbc *hashLBConfig) base.PickerBuilder {
+		b := &consistentHashPickerBuilder{
+			consistentHashConfig: c,
+			loads:                make(map[balancer.SubConn]*int64),
+			total:                new(int64),
+		}
+		b.ring = b.newRing()
+		return b
+	})
 }
 
+// consistentHashPickerBuilder keeps its ring between builds and only applies
+// the difference to the previous ready set, each picker gets a snapshot. The
+// in-flight requests of the bounded loads are kept across pickers too, total
+// counts those of SubConns that went away until they finish.
 type consistentHashPickerBuilder struct {
-	consistentHashKey string
+	consistentHashConfig
+	ring  *Ketama
+	loads map[balancer.SubConn]*int64
+	total *int64
 }
 
 func (b *consistentHashPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	grpclog.Infof("consistentHashPicker: newPicker called with buildInfo: %v", buildInfo)
+	for sc := range b.loads {
+		if _, ok := buildInfo.ReadySCs[sc]; !ok {
+			delete(b.loads, sc)
+		}
+	}
 	if len(buildInfo.ReadySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 
 	picker := &consistentHashPicker{
-		subConns:          make(map[string]balancer.SubConn),
-		hash:              NewKetama(10, nil),
-		consistentHashKey: b.consistentHashKey,
+		subConns:     make(map[string]balancer.SubConn, len(buildInfo.ReadySCs)),
+		keyExtractor: b.keyExtractor,
+		fallback:     newFallbackPicker(b.fallback, b.fallbacks, buildInfo),
+		epsilon:      b.epsilon,
+		loads:        make(map[balancer.SubConn]*int64, len(buildInfo.ReadySCs)),
+		total:        b.total,
 	}
 
+	weights := make(map[string]int, len(buildInfo.ReadySCs))
 	for sc, conInfo := range buildInfo.ReadySCs {
 		weight := common.GetWeight(conInfo.Address)
-		for i := 0; i < weight; i++ {
-			node := wrapAddr(conInfo.Address.Addr, i)
-			picker.hash.Add(node)
-			picker.subConns[node] = sc
+		if weight <= 0 {
+			continue
+		}
+		weights[conInfo.Address.Addr] = weight
+		picker.subConns[conInfo.Address.Addr] = sc
+		load, ok := b.loads[sc]
+		if !ok {
+			load = new(int64)
+			b.loads[sc] = load
 		}
+		picker.loads[sc] = load
+	}
+	b.ring.Set(weights)
+	picker.ring = b.ring.snapshot()
+	if len(picker.loads) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 	return picker
 }
 
+func (b *consistentHashPickerBuilder) newRing() *Ketama {
+	if b.ringSize > 0 {
+		return NewWeightedKetama(b.ringSize, b.hash)
+	}
+	return NewKetama(b.replicas, b.hash)
+}
+
 type consistentHashPicker struct {
-	subConns          map[string]balancer.SubConn
-	hash              *Ketama
-	consistentHashKey string
+	subConns     map[string]balancer.SubConn
+	ring         *ketamaRing
+	keyExtractor KeyExtractor
+	fallback     *fallbackPicker
+
+	epsilon float64
+	loads   map[balancer.SubConn]*int64
+	total   *int64
 }
 
 func (p *consistentHashPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	var ret balancer.PickResult
-	key, ok := info.Ctx.Value(p.consistentHashKey).(string)
+	key, ok := p.keyExtractor(info)
+	if !ok {
+		return p.fallback.Pick(info)
+	}
+	if p.epsilon > 0 {
+		return p.pickBounded(key)
+	}
+	targetAddr, ok := p.ring.get(key)
 	if ok {
-		targetAddr, ok := p.hash.Get(key)
-		if ok {
-			ret.SubConn = p.subConns[targetAddr]
-		}
+		ret.SubConn = p.subConns[targetAddr]
 	}
 	return ret, nil
 }
 
-func wrapAddr(addr string, idx int) string {
-	return fmt.Sprintf("%s-%d", addr, idx)
+// pickBounded walks the ring clockwise from the owner of key and picks the
+// first SubConn whose load is below the cap.
+func (p *consistentHashPicker) pickBounded(key string) (balancer.PickResult, error) {
+	var ret balancer.PickResult
+	total := atomic.LoadInt64(p.total)
+	limit := int64(math.Ceil(float64(total+1) / float64(len(p.loads)) * (1 + p.epsilon)))
+
+	var owner balancer.SubConn
+	p.ring.walk(key, func(node string) bool {
+		sc := p.subConns[node]
+		if owner == nil {
+			owner = sc
+		}
+		if atomic.LoadInt64(p.loads[sc]) < limit {
+			ret.SubConn = sc
+			return false
+		}
+		return true
+	})
+	if ret.SubConn == nil {
+		// every SubConn is at the cap, fall back to the owner
+		ret.SubConn = owner
+	}
+	if ret.SubConn == nil {
+		return ret, nil
+	}
+	return p.track(ret.SubConn), nil
+}
+
+func (p *consistentHashPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	if _, ok := p.loads[sc]; !ok {
+		return balancer.PickResult{}, false
+	}
+	if p.epsilon > 0 {
+		return p.track(sc), true
+	}
+	return balancer.PickResult{SubConn: sc}, true
+}
+
+// track counts a request to sc in the loads until Done.
+func (p *consistentHashPicker) track(sc balancer.SubConn) balancer.PickResult {
+	load := p.loads[sc]
+	atomic.AddInt64(load, 1)
+	atomic.AddInt64(p.total, 1)
+	return balancer.PickResult{
+		SubConn: sc,
+		Done: func(info balancer.DoneInfo) {
+			atomic.AddInt64(load, -1)
+			atomic.AddInt64(p.total, -1)
+		},
+	}
 }
@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"math"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConsistentHashBoundedLoad(t *testing.T) {
+	const epsilon = 0.25
+	b := benchPickerBuilder(NewConsistentHashBuilder(ConsistentHash, DefaultConsistentHashKey, WithBoundedLoad(epsilon))).(*consistentHashPickerBuilder)
+	info := benchBuildInfo(4)
+	bySubConn := make(map[balancer.SubConn]string)
+	for sc, conInfo := range info.ReadySCs {
+		bySubConn[sc] = conInfo.Address.Addr
+	}
+	pickInfo := balancer.PickInfo{Ctx: testHashContext()}
+	// the SubConns clockwise from the owner of the hot key
+	b.Build(info)
+	clockwise := b.ring.GetN("test-key", len(info.ReadySCs))
+
+	var inflight []balancer.PickResult
+	picked := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		// a rebuild keeps the requests in flight
+		p := b.Build(info).(*consistentHashPicker)
+		ret, err := p.Pick(pickInfo)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		inflight = append(inflight, ret)
+		picked[bySubConn[ret.SubConn]]++
+
+		limit := int(math.Ceil(float64(len(inflight)) / float64(len(info.ReadySCs)) * (1 + epsilon)))
+		for addr, n := range picked {
+			if n > limit {
+				t.Fatalf("pick %d: %s has %d requests in flight, cap %d", i, addr, n, limit)
+			}
+		}
+		// the SubConns in use are the owner and those following it clockwise
+		for j, addr := range clockwise {
+			if picked[addr] == 0 {
+				for _, later := range clockwise[j:] {
+					if picked[later] != 0 {
+						t.Fatalf("pick %d: %s used before %s, picks %v, clockwise %v", i, later, addr, picked, clockwise)
+					}
+				}
+				break
+			}
+		}
+	}
+	if picked[clockwise[0]] == len(inflight) {
+		t.Fatalf("hot key never overflowed its owner: %v", picked)
+	}
+
+	for _, ret := range inflight {
+		ret.Done(balancer.DoneInfo{})
+	}
+	if got := atomic.LoadInt64(b.total); got != 0 {
+		t.Fatalf("%d requests in flight after Done, want 0", got)
+	}
+}
@@ -0,0 +1,83 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"sync/atomic"
+)
+
+// FallbackPolicy decides how the hashing pickers handle a request that
+// carries no hash key.
+type FallbackPolicy int
+
+const (
+	// FallbackRoundRobin sends requests without a key round robin.
+	FallbackRoundRobin FallbackPolicy = iota
+	// FallbackRandom sends requests without a key to a random SubConn.
+	FallbackRandom
+	// FallbackFail fails requests without a key with codes.InvalidArgument.
+	FallbackFail
+)
+
+var errMissingHashKey = status.Error(codes.InvalidArgument, "grpclb: hash key is missing")
+
+var (
+	fallbackMu       sync.Mutex
+	fallbackCounters = make(map[string]*int64)
+)
+
+// FallbackCount returns how often the fallback policy fired for requests
+// without a hash key in the balancer registered under name.
+func FallbackCount(name string) int64 {
+	fallbackMu.Lock()
+	counter, ok := fallbackCounters[name]
+	fallbackMu.Unlock()
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(counter)
+}
+
+// fallbackCounter returns the counter of the balancer registered under name.
+// Builders registered again under the same name share the counter.
+func fallbackCounter(name string) *int64 {
+	fallbackMu.Lock()
+	defer fallbackMu.Unlock()
+
+	counter, ok := fallbackCounters[name]
+	if !ok {
+		counter = new(int64)
+		fallbackCounters[name] = counter
+	}
+	return counter
+}
+
+// fallbackPicker picks for the requests a hashing picker has no key for.
+type fallbackPicker struct {
+	picker  balancer.Picker
+	counter *int64
+}
+
+func newFallbackPicker(policy FallbackPolicy, counter *int64, buildInfo base.PickerBuildInfo) *fallbackPicker {
+	var picker balancer.Picker
+	switch policy {
+	case FallbackRandom:
+		picker = (&randomPickerBuilder{}).Build(buildInfo)
+	case FallbackFail:
+		picker = base.NewErrPicker(errMissingHashKey)
+	default:
+		picker = (&roundRobinPickerBuilder{}).Build(buildInfo)
+	}
+	return &fallbackPicker{
+		picker:  picker,
+		counter: counter,
+	}
+}
+
+func (p *fallbackPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	atomic.AddInt64(p.counter, 1)
+	return p.picker.Pick(info)
+}
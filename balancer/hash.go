@@ -0,0 +1,121 @@
+package balancer
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math/bits"
+)
+
+// Hash functions for WithHashFunc and the hash_func setting of the service
+// config.
+var (
+	// FNVHash is 32 bit FNV-1, the default.
+	FNVHash HashFunc = DefaultHash
+	// XXHash is 32 bit xxHash with seed 0.
+	XXHash HashFunc = xxHash32
+	// Murmur3Hash is 32 bit MurmurHash3 (x86_32) with seed 0.
+	Murmur3Hash HashFunc = murmur3Hash32
+	// CRC32Hash is CRC-32 with the IEEE polynomial.
+	CRC32Hash HashFunc = crc32.ChecksumIEEE
+)
+
+var hashFuncs = map[string]HashFunc{
+	"fnv":     FNVHash,
+	"xxhash":  XXHash,
+	"murmur3": Murmur3Hash,
+	"crc32":   CRC32Hash,
+}
+
+const (
+	xxPrime1 uint32 = 2654435761
+	xxPrime2 uint32 = 2246822519
+	xxPrime3 uint32 = 3266489917
+	xxPrime4 uint32 = 668265263
+	xxPrime5 uint32 = 374761393
+)
+
+func xxHash32(data []byte) uint32 {
+	n := len(data)
+	var h uint32
+	if n >= 16 {
+		v1, v2, v3, v4 := xxPrime1, xxPrime2, uint32(0), uint32(0)
+		v1 += xxPrime2
+		v4 -= xxPrime1
+		for len(data) >= 16 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint32(data[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint32(data[4:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint32(data[8:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint32(data[12:]))
+			data = data[16:]
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = xxPrime5
+	}
+	h += uint32(n)
+
+	for len(data) >= 4 {
+		h += binary.LittleEndian.Uint32(data) * xxPrime3
+		h = bits.RotateLeft32(h, 17) * xxPrime4
+		data = data[4:]
+	}
+	for _, b := range data {
+		h += uint32(b) * xxPrime5
+		h = bits.RotateLeft32(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 15
+	h *= xxPrime2
+	h ^= h >> 13
+	h *= xxPrime3
+	h ^= h >> 16
+	return h
+}
+
+func xxRound(acc, input uint32) uint32 {
+	acc += input * xxPrime2
+	return bits.RotateLeft32(acc, 13) * xxPrime1
+}
+
+func murmur3Hash32(data []byte) uint32 {
+	const (
+		c1 uint32 = 0xcc9e2d51
+		c2 uint32 = 0x1b873593
+	)
+	n := len(data)
+	var h uint32
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+		h = bits.RotateLeft32(h, 13)
+		h = h*5 + 0xe6546b64
+		data = data[4:]
+	}
+
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = bits.RotateLeft32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
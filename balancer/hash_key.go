@@ -0,0 +1,45 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+)
+
+// KeyExtractor extracts the hash key of a request for the consistent_hash_x,
+// maglev_x and rendezvous_x pickers. It returns false if the request carries
+// no key.
+type KeyExtractor func(info balancer.PickInfo) (string, bool)
+
+// ContextValueKey returns a KeyExtractor reading a string stored in the RPC
+// context under key. key should be of an unexported type to avoid collisions.
+func ContextValueKey(key interface{}) KeyExtractor {
+	return func(info balancer.PickInfo) (string, bool) {
+		value, ok := info.Ctx.Value(key).(string)
+		return value, ok
+	}
+}
+
+// MetadataKey returns a KeyExtractor reading the first value of the given
+// header from the outgoing metadata, so that the key can be set by
+// interceptors and gateways.
+func MetadataKey(header string) KeyExtractor {
+	return func(info balancer.PickInfo) (string, bool) {
+		md, ok := metadata.FromOutgoingContext(info.Ctx)
+		if !ok {
+			return "", false
+		}
+		values := md.Get(header)
+		if len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+}
+
+// FullMethodKey returns a KeyExtractor using the full method name of the RPC
+// as the key, so that all calls of one method land on the same backend.
+func FullMethodKey() KeyExtractor {
+	return func(info balancer.PickInfo) (string, bool) {
+		return info.FullMethodName, info.FullMethodName != ""
+	}
+}
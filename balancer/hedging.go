@@ -0,0 +1,191 @@
+package balancer
+
+import (
+	"context"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgingConfig configures the hedging interceptor.
+type HedgingConfig struct {
+	// Methods are the full names of the idempotent methods to hedge, all
+	// methods are hedged if it is empty.
+	Methods []string
+	// Delay is how long to wait for a response before sending a hedged copy
+	// of the request.
+	Delay time.Duration
+	// Percentile, e.g. 0.95, replaces Delay by that percentile of the recent
+	// successful latencies once MinSamples latencies are known.
+	Percentile float64
+	MinSamples int
+	// MaxAttempts is the number of copies sent at most, the original
+	// included.
+	MaxAttempts int
+}
+
+var DefaultHedgingConfig = HedgingConfig{
+	Delay:       100 * time.Millisecond,
+	MinSamples:  100,
+	MaxAttempts: 2,
+}
+
+// latencyWindow is the number of latencies the percentile is computed over.
+const latencyWindow = 1024
+
+func (c HedgingConfig) withDefaults() HedgingConfig {
+	d := DefaultHedgingConfig
+	if c.Delay <= 0 {
+		c.Delay = d.Delay
+	}
+	if c.MinSamples <= 0 {
+		c.MinSamples = d.MinSamples
+	}
+	if c.MaxAttempts <= 1 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	return c
+}
+
+// HedgingUnaryClientInterceptor sends a copy of a call to another backend when
+// it has not completed within the hedging delay. The first successful
+// response is returned and the other attempts are cancelled. The ClientConn
+// must use a balancer wrapped by InitAttemptBuilder, InitOutlierDetectionBuilder
+// or InitCircuitBreakerBuilder, which keeps the copies on different SubConns.
+//
+// Only the first attempt fills in the Header, Trailer and Peer call options.
+func HedgingUnaryClientInterceptor(config HedgingConfig) grpc.UnaryClientInterceptor {
+	h := &hedger{
+		config:  config.withDefaults(),
+		methods: make(map[string]bool),
+	}
+	for _, method := range config.Methods {
+		h.methods[method] = true
+	}
+	return h.intercept
+}
+
+type hedger struct {
+	config  HedgingConfig
+	methods map[string]bool
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	next      int
+	delay     time.Duration // percentile of latencies, 0 until computed
+}
+
+type hedgeResult struct {
+	reply proto.Message
+	err   error
+}
+
+func (h *hedger) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	out, ok := reply.(proto.Message)
+	if !ok || len(h.methods) > 0 && !h.methods[method] {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	if attemptsFromContext(ctx) == nil {
+		ctx = withAttempts(ctx, &attempts{})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	results := make(chan hedgeResult, h.config.MaxAttempts)
+	attempt := func(opts []grpc.CallOption) {
+		start := time.Now()
+		r := proto.Clone(out)
+		r.Reset()
+		err := invoker(ctx, method, req, r, cc, opts...)
+		if err == nil {
+			h.observe(time.Since(start))
+		}
+		results <- hedgeResult{reply: r, err: err}
+	}
+
+	go attempt(opts)
+	pending := 1
+	sent := 1
+	timer := time.NewTimer(h.hedgeDelay())
+	defer timer.Stop()
+
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if sent < h.config.MaxAttempts {
+				go attempt(hedgeCallOptions(opts))
+				pending++
+				sent++
+				timer.Reset(h.hedgeDelay())
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				// wait for the other attempts, if any
+				err = res.err
+				continue
+			}
+			cancel()
+			for ; pending > 0; pending-- {
+				<-results
+			}
+			out.Reset()
+			proto.Merge(out, res.reply)
+			return nil
+		}
+	}
+	cancel()
+	return err
+}
+
+// hedgeCallOptions drops the options the first attempt writes to.
+func hedgeCallOptions(opts []grpc.CallOption) []grpc.CallOption {
+	var ret []grpc.CallOption
+	for _, opt := range opts {
+		switch opt.(type) {
+		case grpc.HeaderCallOption, grpc.TrailerCallOption, grpc.PeerCallOption:
+			continue
+		}
+		ret = append(ret, opt)
+	}
+	return ret
+}
+
+func (h *hedger) hedgeDelay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.delay > 0 {
+		return h.delay
+	}
+	return h.config.Delay
+}
+
+func (h *hedger) observe(latency time.Duration) {
+	if h.config.Percentile <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.latencies) < latencyWindow {
+		h.latencies = append(h.latencies, latency)
+	} else {
+		h.latencies[h.next] = latency
+	}
+	h.next = (h.next + 1) % latencyWindow
+	// recompute from time to time, sorting on every call is too expensive
+	if len(h.latencies) < h.config.MinSamples || h.next%32 != 0 {
+		return
+	}
+	sorted := make([]time.Duration, len(h.latencies))
+	copy(sorted, h.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(h.config.Percentile * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	h.delay = sorted[i]
+}
@@ -0,0 +1,47 @@
+package balancer
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes/empty"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHedgingPicksAnotherSubConn(t *testing.T) {
+	cc, b := newTestAttemptConn(t, 3)
+	defer b.Close()
+
+	var mu sync.Mutex
+	var picked []balancer.SubConn
+	invoker := cc.invoker(func(ctx context.Context, sc balancer.SubConn) error {
+		mu.Lock()
+		picked = append(picked, sc)
+		first := len(picked) == 1
+		mu.Unlock()
+		if first {
+			// the first attempt hangs until the hedged one succeeds
+			<-ctx.Done()
+			return status.Error(codes.Canceled, ctx.Err().Error())
+		}
+		return nil
+	})
+
+	intercept := HedgingUnaryClientInterceptor(HedgingConfig{Delay: 10 * time.Millisecond})
+	for i := 0; i < 10; i++ {
+		mu.Lock()
+		picked = nil
+		mu.Unlock()
+		if err := intercept(testHashContext(), "/test.Service/Method", &empty.Empty{}, &empty.Empty{}, nil, invoker); err != nil {
+			t.Fatalf("call %d: %v", i, err)
+		}
+		mu.Lock()
+		if len(picked) != 2 || picked[0] == picked[1] {
+			t.Fatalf("call %d: attempts picked %v, want two different SubConns", i, picked)
+		}
+		mu.Unlock()
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"sort"
 	"strconv"
 	"sync"
+	"sync/atomic"
 )
 
 type HashFunc func(data []byte) uint32
@@ -20,19 +21,32 @@ func DefaultHash(data []byte) uint32 {
 	return f.Sum32()
 }
 
+// Ketama is a consistent hash ring. Every node owns a number of virtual nodes
+// proportional to its weight: replicas per unit of weight, or a share of a
+// total ring size budget for rings created with NewWeightedKetama.
+//
+// Lookups read an immutable snapshot of the ring and never wait for updates.
+// An update only hashes the virtual nodes that changed and merges them into a
+// copy of the snapshot.
 type Ketama struct {
-	sync.Mutex
-	hash     HashFunc
-	replicas int
-	keys     []int //  Sorted keys
-	hashMap  map[int]string
+	sync.Mutex // serializes updates
+	hash       HashFunc
+	replicas   int
+	size       int
+	weights    map[string]int
+	total      int            // sum of the weights
+	points     map[string]int // virtual nodes by node
+	added      []ketamaPoint
+	removed    []ketamaPoint
+	ring       atomic.Value // *ketamaRing
 }
 
 func NewKetama(replicas int, fn HashFunc) *Ketama {
 	h := &Ketama{
 		replicas: replicas,
 		hash:     fn,
-		hashMap:  make(map[int]string),
+		weights:  make(map[string]int),
+		points:   make(map[string]int),
 	}
 	if h.replicas <= 0 {
 		h.replicas = DefaultReplicas
@@ -40,94 +54,250 @@ func NewKetama(replicas int, fn HashFunc) *Ketama {
 	if h.hash == nil {
 		h.hash = DefaultHash
 	}
+	h.ring.Store(&ketamaRing{hash: h.hash})
 	return h
 }
 
-func (h *Ketama) IsEmpty() bool {
-	h.Lock()
-	defer h.Unlock()
+// NewWeightedKetama creates a ring of about size virtual nodes, which the
+// nodes share in proportion to their weights. Every node keeps at least one
+// virtual node, and a change of the total weight only adds or removes the last
+// virtual nodes of each node, so most keys stay where they are.
+func NewWeightedKetama(size int, fn HashFunc) *Ketama {
+	h := NewKetama(0, fn)
+	h.size = size
+	return h
+}
 
-	return len(h.keys) == 0
+func (h *Ketama) IsEmpty() bool {
+	return len(h.snapshot().keys) == 0
 }
 
+// Add adds nodes with weight 1.
 func (h *Ketama) Add(nodes ...string) {
 	h.Lock()
 	defer h.Unlock()
 
 	for _, node := range nodes {
-		for i := 0; i < h.replicas; i++ {
-			key := int(h.hash([]byte(Salt + strconv.Itoa(i) + node)))
+		h.setWeight(node, 1)
+	}
+	h.update()
+}
 
-			if _, ok := h.hashMap[key]; !ok {
-				h.keys = append(h.keys, key)
-			}
-			h.hashMap[key] = node
-		}
+// AddWeighted adds a node with the given weight, or updates the weight of an
+// existing node. Nodes with a weight <= 0 are ignored.
+func (h *Ketama) AddWeighted(node string, weight int) {
+	if weight <= 0 {
+		return
 	}
-	sort.Ints(h.keys)
+	h.Lock()
+	defer h.Unlock()
+
+	h.setWeight(node, weight)
+	h.update()
 }
 
 func (h *Ketama) Remove(nodes ...string) {
 	h.Lock()
 	defer h.Unlock()
 
-	deletedKey := make([]int, 0)
 	for _, node := range nodes {
-		for i := 0; i < h.replicas; i++ {
-			key := int(h.hash([]byte(Salt + strconv.Itoa(i) + node)))
+		h.setWeight(node, 0)
+	}
+	h.update()
+}
 
-			if _, ok := h.hashMap[key]; ok {
-				deletedKey = append(deletedKey, key)
-				delete(h.hashMap, key)
-			}
+// Set makes the ring hold exactly the nodes of weights, in one update that
+// only touches the nodes that were added, removed or reweighted. Nodes with a
+// weight <= 0 are left out.
+func (h *Ketama) Set(weights map[string]int) {
+	h.Lock()
+	defer h.Unlock()
+
+	for node := range h.weights {
+		if weights[node] <= 0 {
+			h.setWeight(node, 0)
 		}
 	}
-	if len(deletedKey) > 0 {
-		h.deleteKeys(deletedKey)
+	for node, weight := range weights {
+		if weight > 0 && weight != h.weights[node] {
+			h.setWeight(node, weight)
+		}
 	}
+	h.update()
 }
 
-func (h *Ketama) deleteKeys(deletedKeys []int) {
-	sort.Ints(deletedKeys)
-
-	index := 0
-	count := 0
-	for _, key := range deletedKeys {
-		for ; index < len(h.keys); index++ {
-			h.keys[index-count] = h.keys[index]
+func (h *Ketama) setWeight(node string, weight int) {
+	h.total += weight - h.weights[node]
+	if weight > 0 {
+		h.weights[node] = weight
+	} else {
+		delete(h.weights, node)
+	}
+	if h.size <= 0 {
+		h.setPoints(node, weight*h.replicas)
+	}
+}
 
-			if key == h.keys[index] {
-				count++
-				index++
-				break
+// update spreads the ring size budget after a weight change and publishes a
+// new snapshot with the pending changes.
+func (h *Ketama) update() {
+	if h.size > 0 {
+		for node := range h.points {
+			if _, ok := h.weights[node]; !ok {
+				h.setPoints(node, 0)
 			}
 		}
+		for node, weight := range h.weights {
+			n := int(int64(h.size) * int64(weight) / int64(h.total))
+			if n < 1 {
+				n = 1
+			}
+			h.setPoints(node, n)
+		}
 	}
+	if len(h.added) == 0 && len(h.removed) == 0 {
+		return
+	}
+	r := h.snapshot().merge(h.added, h.removed)
+	r.distinct = len(h.points)
+	h.ring.Store(r)
+	h.added = h.added[:0]
+	h.removed = h.removed[:0]
+}
 
-	for ; index < len(h.keys); index++ {
-		h.keys[index-count] = h.keys[index]
+// setPoints adds or removes the last virtual nodes of node until it has n.
+func (h *Ketama) setPoints(node string, n int) {
+	old := h.points[node]
+	for i := old; i < n; i++ {
+		h.added = append(h.added, h.point(node, i))
 	}
+	for i := n; i < old; i++ {
+		h.removed = append(h.removed, h.point(node, i))
+	}
+	if n > 0 {
+		h.points[node] = n
+	} else {
+		delete(h.points, node)
+	}
+}
+
+func (h *Ketama) point(node string, i int) ketamaPoint {
+	return ketamaPoint{key: int(h.hash([]byte(Salt + strconv.Itoa(i) + node))), node: node}
+}
 
-	h.keys = h.keys[:len(h.keys)-count]
+func (h *Ketama) snapshot() *ketamaRing {
+	return h.ring.Load().(*ketamaRing)
 }
 
 func (h *Ketama) Get(key string) (string, bool) {
-	if h.IsEmpty() {
-		return "", false
+	return h.snapshot().get(key)
+}
+
+// GetN returns up to n distinct nodes for key: the owner, followed by the next
+// distinct nodes clockwise on the ring.
+func (h *Ketama) GetN(key string, n int) []string {
+	r := h.snapshot()
+	if n <= 0 {
+		return nil
 	}
+	var ret []string
+	seen := make(map[string]bool)
+	r.walk(key, func(node string) bool {
+		if !seen[node] {
+			seen[node] = true
+			ret = append(ret, node)
+		}
+		return len(ret) < n && len(ret) < r.distinct
+	})
+	return ret
+}
 
-	hash := int(h.hash([]byte(key)))
+type ketamaPoint struct {
+	key  int
+	node string
+}
 
-	h.Lock()
-	defer h.Unlock()
+// ketamaRing is an immutable snapshot of a Ketama ring, sorted by key and
+// then node.
+type ketamaRing struct {
+	hash     HashFunc
+	keys     []int
+	nodes    []string
+	distinct int // number of nodes
+}
 
-	idx := sort.Search(len(h.keys), func(i int) bool {
-		return h.keys[i] >= hash
+// merge returns a copy of the ring with the points of added and without the
+// points of removed, which must be on the ring. Only the changed points are
+// sorted, the rest is a linear merge.
+func (r *ketamaRing) merge(added, removed []ketamaPoint) *ketamaRing {
+	sortKetamaPoints(added)
+	sortKetamaPoints(removed)
+	size := len(r.keys) + len(added) - len(removed)
+	ret := &ketamaRing{
+		hash:  r.hash,
+		keys:  make([]int, 0, size),
+		nodes: make([]string, 0, size),
+	}
+	i, j := 0, 0
+	push := func(p ketamaPoint) {
+		if j < len(removed) && removed[j] == p {
+			j++
+			return
+		}
+		ret.keys = append(ret.keys, p.key)
+		ret.nodes = append(ret.nodes, p.node)
+	}
+	for _, p := range added {
+		for ; i < len(r.keys) && ketamaLess(ketamaPoint{r.keys[i], r.nodes[i]}, p); i++ {
+			push(ketamaPoint{r.keys[i], r.nodes[i]})
+		}
+		push(p)
+	}
+	for ; i < len(r.keys); i++ {
+		push(ketamaPoint{r.keys[i], r.nodes[i]})
+	}
+	return ret
+}
+
+func sortKetamaPoints(points []ketamaPoint) {
+	sort.Slice(points, func(i, j int) bool {
+		return ketamaLess(points[i], points[j])
 	})
+}
 
-	if idx == len(h.keys) {
+func ketamaLess(a, b ketamaPoint) bool {
+	if a.key == b.key {
+		return a.node < b.node
+	}
+	return a.key < b.key
+}
+
+func (r *ketamaRing) search(key string) int {
+	hash := int(r.hash([]byte(key)))
+	idx := sort.SearchInts(r.keys, hash)
+	if idx == len(r.keys) {
 		idx = 0
 	}
-	str, ok := h.hashMap[h.keys[idx]]
-	return str, ok
+	return idx
+}
+
+func (r *ketamaRing) get(key string) (string, bool) {
+	if len(r.keys) == 0 {
+		return "", false
+	}
+	return r.nodes[r.search(key)], true
+}
+
+// walk calls fn for each node on the ring clockwise from the owner of key,
+// until fn returns false or the whole ring has been visited.
+func (r *ketamaRing) walk(key string, fn func(node string) bool) {
+	if len(r.keys) == 0 {
+		return
+	}
+	idx := r.search(key)
+	for i := 0; i < len(r.keys); i++ {
+		if !fn(r.nodes[(idx+i)%len(r.keys)]) {
+			return
+		}
+	}
 }
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// ketamaFromScratch returns the points that h should hold for weights,
+// computed without the incremental updates of h.
+func ketamaFromScratch(h *Ketama, weights map[string]int) []ketamaPoint {
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	var points []ketamaPoint
+	for node, weight := range weights {
+		n := weight * h.replicas
+		if h.size > 0 {
+			n = h.size * weight / total
+			if n < 1 {
+				n = 1
+			}
+		}
+		for i := 0; i < n; i++ {
+			points = append(points, h.point(node, i))
+		}
+	}
+	sortKetamaPoints(points)
+	return points
+}
+
+func ketamaPoints(h *Ketama) []ketamaPoint {
+	r := h.snapshot()
+	var points []ketamaPoint
+	for i := range r.keys {
+		points = append(points, ketamaPoint{r.keys[i], r.nodes[i]})
+	}
+	return points
+}
+
+func TestKetamaSetChurn(t *testing.T) {
+	modes := []struct {
+		name    string
+		newRing func() *Ketama
+	}{
+		{"replicas", func() *Ketama { return NewKetama(10, nil) }},
+		{"weighted", func() *Ketama { return NewWeightedKetama(1000, nil) }},
+	}
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			h := mode.newRing()
+			for round := 0; round < 200; round++ {
+				// every node is left out, kept or reweighted at random
+				weights := make(map[string]int)
+				for i := 0; i < 20; i++ {
+					if weight := r.Intn(6) - 1; weight != 0 {
+						weights["node"+strconv.Itoa(i)] = weight
+					}
+				}
+				h.Set(weights)
+
+				for node, weight := range weights {
+					if weight <= 0 {
+						delete(weights, node)
+					}
+				}
+				want := ketamaFromScratch(h, weights)
+				if got := ketamaPoints(h); !reflect.DeepEqual(got, want) {
+					t.Fatalf("round %d: ring has %d points, want %d from scratch", round, len(got), len(want))
+				}
+				if got := h.snapshot().distinct; got != len(weights) {
+					t.Fatalf("round %d: ring has %d distinct nodes, want %d", round, got, len(weights))
+				}
+
+				fresh := mode.newRing()
+				fresh.Set(weights)
+				for i := 0; i < 100; i++ {
+					key := strconv.Itoa(r.Int())
+					got, _ := h.Get(key)
+					want, _ := fresh.Get(key)
+					if got != want {
+						t.Fatalf("round %d: Get(%q) = %q, want %q", round, key, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestKetamaGetN(t *testing.T) {
+	h := NewKetama(10, nil)
+	if got := h.GetN("key", 2); got != nil {
+		t.Fatalf("GetN on an empty ring = %v, want nil", got)
+	}
+
+	h.Add("a", "b", "c", "d")
+	h.AddWeighted("e", 3)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if got := h.GetN(key, 0); got != nil {
+			t.Fatalf("GetN(%q, 0) = %v, want nil", key, got)
+		}
+
+		// the distinct nodes clockwise from the owner of key
+		r := h.snapshot()
+		var want []string
+		idx := sort.SearchInts(r.keys, int(r.hash([]byte(key))))
+		for j := 0; j < len(r.keys) && len(want) < 5; j++ {
+			node := r.nodes[(idx+j)%len(r.keys)]
+			if !containsString(want, node) {
+				want = append(want, node)
+			}
+		}
+
+		owner, _ := h.Get(key)
+		if want[0] != owner {
+			t.Fatalf("Get(%q) = %q, want %q", key, owner, want[0])
+		}
+		for n := 1; n <= 5; n++ {
+			if got := h.GetN(key, n); !reflect.DeepEqual(got, want[:n]) {
+				t.Fatalf("GetN(%q, %d) = %v, want %v", key, n, got, want[:n])
+			}
+		}
+		if got := h.GetN(key, 10); !reflect.DeepEqual(got, want) {
+			t.Fatalf("GetN(%q, 10) = %v, want all nodes %v", key, got, want)
+		}
+	}
+
+	h.Remove("c")
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		got := h.GetN(key, 10)
+		if len(got) != 4 || containsString(got, "c") {
+			t.Fatalf("GetN(%q, 10) after removing c = %v", key, got)
+		}
+	}
+}
+
+func TestWeightedKetamaGetN(t *testing.T) {
+	h := NewWeightedKetama(100, nil)
+	h.Set(map[string]int{"a": 1000, "b": 1, "c": 1})
+	// b and c keep one virtual node each next to a large share of a
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		got := h.GetN(key, 3)
+		sorted := append([]string(nil), got...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, []string{"a", "b", "c"}) {
+			t.Fatalf("GetN(%q, 3) = %v, want a, b and c", key, got)
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
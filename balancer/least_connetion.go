@@ -1,29 +1,58 @@
 package balancer
 
 import (
+	"encoding/json"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 	"google.golang.org/grpc/grpclog"
-	"math/rand"
-	"sync"
+	"google.golang.org/grpc/serviceconfig"
 	"sync/atomic"
-	"time"
 )
 
 const LeastConnection = "least_connection_x"
 
+// DefaultChoiceCount is the number of random SubConns least_connection_x and
+// peak_ewma_x compare on every pick.
+const DefaultChoiceCount = 2
+
+// choiceLBConfig is the service config of least_connection_x, e.g.
+// {"choice_count": 3}.
+type choiceLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	ChoiceCount int `json:"choice_count,omitempty"`
+}
+
+func (c *choiceLBConfig) choiceCount() int {
+	if c == nil || c.ChoiceCount <= 0 {
+		return DefaultChoiceCount
+	}
+	return c.ChoiceCount
+}
+
 // newLeastConnectionBuilder creates a new leastConnection balancer builder.
 func newLeastConnectionBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(LeastConnection, &leastConnectionPickerBuilder{}, base.Config{HealthCheck: true})
+	return &configBuilder{
+		name: LeastConnection,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			return parseLBConfig(LeastConnection, js, &choiceLBConfig{})
+		},
+		newPickerBuilder: func(config serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			c, _ := config.(*choiceLBConfig)
+			return &leastConnectionPickerBuilder{choices: c.choiceCount()}
+		},
+	}
 }
 
 func init() {
 	balancer.Register(newLeastConnectionBuilder())
 }
 
-type leastConnectionPickerBuilder struct{}
+type leastConnectionPickerBuilder struct {
+	choices int
+}
 
-func (*leastConnectionPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+func (b *leastConnectionPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	grpclog.Infof("leastConnectionPicker: newPicker called with buildInfo: %v", buildInfo)
 
 	if len(buildInfo.ReadySCs) == 0 {
@@ -35,9 +64,13 @@ func (*leastConnectionPickerBuilder) Build(buildInfo base.PickerBuildInfo) balan
 		nodes = append(nodes, &Node{subConn, 0})
 	}
 
+	choices := b.choices
+	if choices <= 0 {
+		choices = DefaultChoiceCount
+	}
 	return &leastConnectionPicker{
-		nodes: nodes,
-		rand:  rand.New(rand.NewSource(time.Now().Unix())),
+		nodes:   nodes,
+		choices: choices,
 	}
 }
 
@@ -47,9 +80,8 @@ type Node struct {
 }
 
 type leastConnectionPicker struct {
-	nodes []*Node
-	mu    sync.Mutex
-	rand  *rand.Rand
+	nodes   []*Node
+	choices int
 }
 
 func (p *leastConnectionPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
@@ -57,29 +89,71 @@ func (p *leastConnectionPicker) Pick(info balancer.PickInfo) (balancer.PickResul
 	if len(p.nodes) == 0 {
 		return ret, balancer.ErrNoSubConnAvailable
 	}
-	var node *Node
-	if len(p.nodes) == 1 {
-		node = p.nodes[0]
-	} else {
-		p.mu.Lock()
-		a := p.rand.Intn(len(p.nodes))
-		b := p.rand.Intn(len(p.nodes))
-		p.mu.Unlock()
-		if a == b {
-			b = (b + 1) % len(p.nodes)
-		}
-		if p.nodes[a].inflight < p.nodes[b].inflight {
-			node = p.nodes[a]
-		} else {
-			node = p.nodes[b]
+	node := p.nodes[chooseLeast(len(p.nodes), p.choices, func(i int) float64 {
+		return float64(atomic.LoadInt64(&p.nodes[i].inflight))
+	})]
+	return p.track(node), nil
+}
+
+func (p *leastConnectionPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	for _, node := range p.nodes {
+		if node.SubConn == sc {
+			return p.track(node), true
 		}
 	}
+	return balancer.PickResult{}, false
+}
+
+// track counts a request to node until Done.
+func (p *leastConnectionPicker) track(node *Node) balancer.PickResult {
 	atomic.AddInt64(&node.inflight, 1)
+	return balancer.PickResult{
+		SubConn: node.SubConn,
+		Done: func(info balancer.DoneInfo) {
+			atomic.AddInt64(&node.inflight, -1)
+		},
+	}
+}
+
+// chooseLeast returns the index of the least loaded of choices distinct random
+// indexes below n. All indexes are compared, starting at a random one to break
+// ties, if there are not more than choices.
+func chooseLeast(n, choices int, load func(i int) float64) int {
+	if n == 1 {
+		return 0
+	}
+	if n <= choices {
+		start := randIntn(n)
+		best, bestLoad := start, load(start)
+		for k := 1; k < n; k++ {
+			i := (start + k) % n
+			if l := load(i); l < bestLoad {
+				best, bestLoad = i, l
+			}
+		}
+		return best
+	}
 
-	ret.SubConn = node
-	ret.Done = func(info balancer.DoneInfo) {
-		atomic.AddInt64(&node.inflight, -1)
+	indexes := make([]int, 0, choices)
+	for len(indexes) < choices {
+		i := randIntn(n)
+		duplicate := false
+		for _, j := range indexes {
+			if i == j {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			indexes = append(indexes, i)
+		}
 	}
 
-	return ret, nil
+	best, bestLoad := indexes[0], load(indexes[0])
+	for _, i := range indexes[1:] {
+		if l := load(i); l < bestLoad {
+			best, bestLoad = i, l
+		}
+	}
+	return best
 }
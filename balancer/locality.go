@@ -0,0 +1,184 @@
+package balancer
+
+import (
+	"encoding/json"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const Locality = "locality_x"
+
+// LocalityConfig configures the locality_x balancer.
+type LocalityConfig struct {
+	// Locality is the zone of the caller, compared to common.GetLocality of
+	// the addresses.
+	Locality string
+	// SpilloverThreshold is the fraction of the local instances that must be
+	// ready for all traffic to stay local. Below it the local share of the
+	// traffic is ready/(total*SpilloverThreshold) and the rest spills over to
+	// the other zones in proportion to their ready instances.
+	SpilloverThreshold float64
+}
+
+const DefaultSpilloverThreshold = 0.7
+
+func InitLocalityBuilder(config LocalityConfig) {
+	balancer.Register(newLocalityBuilder(config))
+}
+
+// newLocalityBuilder creates a new locality balancer builder.
+func newLocalityBuilder(config LocalityConfig) balancer.Builder {
+	if config.SpilloverThreshold <= 0 || config.SpilloverThreshold > 1 {
+		config.SpilloverThreshold = DefaultSpilloverThreshold
+	}
+	return &localityBuilder{config: config}
+}
+
+type localityBuilder struct {
+	config LocalityConfig
+}
+
+func (b *localityBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	lb := &localityBalancer{defaults: b.config, config: b.config}
+	lb.pb = &rebuildingPickerBuilder{newPicker: (&localityPickerBuilder{lb: lb}).build}
+	lb.Balancer = base.NewBalancerBuilder(Locality, lb.pb, base.Config{HealthCheck: true}).Build(cc, opts)
+	return lb
+}
+
+func (b *localityBuilder) Name() string {
+	return Locality
+}
+
+// localityLBConfig is the service config of locality_x, e.g.
+// {"locality": "us-east-1a", "spillover_threshold": 0.7}.
+type localityLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Locality           string  `json:"locality,omitempty"`
+	SpilloverThreshold float64 `json:"spillover_threshold,omitempty"`
+}
+
+func (b *localityBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseLBConfig(Locality, js, &localityLBConfig{})
+}
+
+// localityBalancer counts the resolved local addresses, which the picker
+// builder compares to the ready local SubConns.
+type localityBalancer struct {
+	balancer.Balancer
+	pb         *rebuildingPickerBuilder
+	defaults   LocalityConfig
+	config     LocalityConfig
+	localTotal int
+}
+
+func (lb *localityBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	config := lb.config
+	if lbc, ok := s.BalancerConfig.(*localityLBConfig); ok {
+		config = lb.defaults
+		if lbc.Locality != "" {
+			config.Locality = lbc.Locality
+		}
+		if lbc.SpilloverThreshold > 0 && lbc.SpilloverThreshold <= 1 {
+			config.SpilloverThreshold = lbc.SpilloverThreshold
+		}
+	}
+	localTotal := 0
+	for _, addr := range s.ResolverState.Addresses {
+		if common.GetLocality(addr) == config.Locality {
+			localTotal++
+		}
+	}
+	// the local share depends on the config and the local total
+	if config != lb.config || localTotal != lb.localTotal {
+		lb.config = config
+		lb.localTotal = localTotal
+		lb.pb.rebuild()
+	}
+	return lb.Balancer.UpdateClientConnState(s)
+}
+
+// localityPickerBuilder splits the ready SubConns into a local and a remote
+// round robin picker by the config and local total of lb.
+type localityPickerBuilder struct {
+	lb *localityBalancer
+}
+
+func (b *localityPickerBuilder) build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("localityPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	config := b.lb.config
+
+	local := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	remote := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for sc, info := range buildInfo.ReadySCs {
+		if common.GetLocality(info.Address) == config.Locality {
+			local.ReadySCs[sc] = info
+		} else {
+			remote.ReadySCs[sc] = info
+		}
+	}
+
+	total := b.lb.localTotal
+	if total < len(local.ReadySCs) {
+		total = len(local.ReadySCs)
+	}
+	share := 1.0
+	if total > 0 {
+		share = float64(len(local.ReadySCs)) / (float64(total) * config.SpilloverThreshold)
+	}
+	if share > 1 || len(remote.ReadySCs) == 0 {
+		share = 1
+	}
+	if len(local.ReadySCs) == 0 {
+		share = 0
+	}
+	grpclog.Infof("localityPicker: %d of %d local SubConns ready, local share %.2f", len(local.ReadySCs), total, share)
+
+	picker := &localityPicker{
+		share: share,
+	}
+	if share > 0 {
+		picker.local = (&roundRobinPickerBuilder{}).Build(local)
+	}
+	if share < 1 {
+		picker.remote = (&roundRobinPickerBuilder{}).Build(remote)
+	}
+	return picker
+}
+
+type localityPicker struct {
+	share  float64 // fraction of the picks that stay local
+	local  balancer.Picker
+	remote balancer.Picker
+}
+
+func (p *localityPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if p.share >= 1 {
+		return p.local.Pick(info)
+	}
+	if p.share <= 0 {
+		return p.remote.Pick(info)
+	}
+	if randFloat64() < p.share {
+		return p.local.Pick(info)
+	}
+	return p.remote.Pick(info)
+}
+
+func (p *localityPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	if p.local != nil {
+		if ret, ok := trySubConn(p.local, info, sc); ok {
+			return ret, true
+		}
+	}
+	if p.remote != nil {
+		return trySubConn(p.remote, info, sc)
+	}
+	return balancer.PickResult{}, false
+}
@@ -0,0 +1,158 @@
+package balancer
+
+import (
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"hash/fnv"
+	"sort"
+)
+
+const Maglev = "maglev_x"
+
+// DefaultMaglevTableSize is the size of the Maglev lookup table. It must be a
+// prime number much larger than the number of backends.
+const DefaultMaglevTableSize = 65537
+
+func init() {
+	balancer.Register(NewMaglevBuilder(Maglev, DefaultConsistentHashKey))
+}
+
+func InitMaglevBuilder(consistentHashKey string, opts ...ConsistentHashOption) {
+	balancer.Register(NewMaglevBuilder(Maglev, consistentHashKey, opts...))
+}
+
+// NewMaglevBuilder creates a maglev balancer builder named name, see
+// NewConsistentHashBuilder.
+func NewMaglevBuilder(name, consistentHashKey string, opts ...ConsistentHashOption) balancer.Builder {
+	config := newConsistentHashConfig(name, consistentHashKey, opts)
+	return newHashPolicyBuilder(name, config, func(c consistentHashConfig, lbc *hashLBConfig) base.PickerBuilder {
+		b := &maglevPickerBuilder{consistentHashConfig: c, tableSize: DefaultMaglevTableSize}
+		if lbc.TableSize > 0 {
+			b.tableSize = lbc.TableSize
+		}
+		return b
+	})
+}
+
+type maglevPickerBuilder struct {
+	consistentHashConfig
+	tableSize int
+}
+
+func (b *maglevPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("maglevPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	var backends []maglevBackend
+	for sc, conInfo := range buildInfo.ReadySCs {
+		weight := common.GetWeight(conInfo.Address)
+		if weight <= 0 {
+			continue
+		}
+		backends = append(backends, maglevBackend{
+			name:    conInfo.Address.Addr,
+			weight:  weight,
+			subConn: sc,
+		})
+	}
+	if len(backends) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	// the table only depends on the backend set, not on map iteration order
+	sort.Slice(backends, func(i, j int) bool {
+		return backends[i].name < backends[j].name
+	})
+
+	table := newMaglevTable(backends, b.tableSize, b.hash)
+	subConns := make([]balancer.SubConn, len(table))
+	for i, idx := range table {
+		subConns[i] = backends[idx].subConn
+	}
+	return &maglevPicker{
+		subConns:     subConns,
+		hash:         b.hash,
+		keyExtractor: b.keyExtractor,
+		fallback:     newFallbackPicker(b.fallback, b.fallbacks, buildInfo),
+	}
+}
+
+type maglevBackend struct {
+	name    string
+	weight  int
+	subConn balancer.SubConn
+}
+
+// newMaglevTable populates a lookup table of the given size with backend
+// indexes, following the algorithm from the Maglev paper. Every round each
+// backend claims as many entries as its weight, taking the next free slot of
+// its own permutation of the table, whose skip comes from hash.
+func newMaglevTable(backends []maglevBackend, size int, hash HashFunc) []int {
+	offsets := make([]uint64, len(backends))
+	skips := make([]uint64, len(backends))
+	for i, b := range backends {
+		offsets[i] = maglevHash([]byte(b.name)) % uint64(size)
+		skips[i] = uint64(hash([]byte(Salt+b.name)))%uint64(size-1) + 1
+	}
+
+	table := make([]int, size)
+	for i := range table {
+		table[i] = -1
+	}
+	next := make([]uint64, len(backends))
+	filled := 0
+	for filled < size {
+		for i, b := range backends {
+			for w := 0; w < b.weight && filled < size; w++ {
+				c := (offsets[i] + next[i]*skips[i]) % uint64(size)
+				for table[c] >= 0 {
+					next[i]++
+					c = (offsets[i] + next[i]*skips[i]) % uint64(size)
+				}
+				table[c] = i
+				next[i]++
+				filled++
+			}
+		}
+	}
+	return table
+}
+
+func maglevHash(data []byte) uint64 {
+	f := fnv.New64a()
+	f.Write(data)
+	return f.Sum64()
+}
+
+type maglevPicker struct {
+	subConns     []balancer.SubConn
+	hash         HashFunc
+	keyExtractor KeyExtractor
+	fallback     *fallbackPicker
+}
+
+func (p *maglevPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var ret balancer.PickResult
+	key, ok := p.keyExtractor(info)
+	if !ok {
+		return p.fallback.Pick(info)
+	}
+	idx := uint64(p.hash([]byte(key))) % uint64(len(p.subConns))
+	ret.SubConn = p.subConns[idx]
+	return ret, nil
+}
+
+func isPrime(n int) bool {
+	if n < 2 {
+		return false
+	}
+	for i := 2; i*i <= n; i++ {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"fmt"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"math"
+	"testing"
+)
+
+func testMaglevBackends(n int) []maglevBackend {
+	var backends []maglevBackend
+	for i := 0; i < n; i++ {
+		backends = append(backends, maglevBackend{name: fmt.Sprintf("10.0.0.%d:8080", i), weight: 1 + i%3})
+	}
+	return backends
+}
+
+func TestMaglevTablePopulated(t *testing.T) {
+	for _, size := range []int{7, 251, DefaultMaglevTableSize} {
+		backends := testMaglevBackends(5)
+		table := newMaglevTable(backends, size, DefaultHash)
+		if len(table) != size {
+			t.Fatalf("table of size %d has %d entries", size, len(table))
+		}
+		for i, idx := range table {
+			if idx < 0 || idx >= len(backends) {
+				t.Fatalf("size %d: entry %d is %d, want a backend", size, i, idx)
+			}
+		}
+	}
+}
+
+func TestMaglevShares(t *testing.T) {
+	info := benchBuildInfo(10)
+	b := benchPickerBuilder(NewMaglevBuilder(Maglev, DefaultConsistentHashKey)).(*maglevPickerBuilder)
+	p := b.Build(info).(*maglevPicker)
+
+	entries := make(map[balancer.SubConn]int)
+	for _, sc := range p.subConns {
+		entries[sc]++
+	}
+	total := 0
+	for _, conInfo := range info.ReadySCs {
+		total += common.GetWeight(conInfo.Address)
+	}
+	for sc, conInfo := range info.ReadySCs {
+		weight := common.GetWeight(conInfo.Address)
+		// the last round of claims may stop before a backend is done
+		want := float64(len(p.subConns)) * float64(weight) / float64(total)
+		if got := entries[sc]; math.Abs(float64(got)-want) > float64(weight) {
+			t.Fatalf("%s of weight %d has %d entries, want %.0f", conInfo.Address.Addr, weight, got, want)
+		}
+	}
+}
+
+func TestMaglevRemoveBackend(t *testing.T) {
+	backends := testMaglevBackends(10)
+	table := newMaglevTable(backends, DefaultMaglevTableSize, DefaultHash)
+	for removed := range backends {
+		rest := append(append([]maglevBackend(nil), backends[:removed]...), backends[removed+1:]...)
+		after := newMaglevTable(rest, DefaultMaglevTableSize, DefaultHash)
+
+		// the entries of the removed backend move, the others stay except
+		// for the few the paper allows
+		moved := 0
+		for i, idx := range table {
+			if idx != removed && rest[after[i]].name != backends[idx].name {
+				moved++
+			}
+		}
+		if limit := DefaultMaglevTableSize / 100; moved > limit {
+			t.Fatalf("removing %s moved %d entries of other backends, want at most %d", backends[removed].name, moved, limit)
+		}
+	}
+}
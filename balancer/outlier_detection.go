@@ -0,0 +1,343 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math"
+	"sync"
+	"time"
+)
+
+const OutlierDetection = "outlier_detection_x"
+
+// OutlierDetectionConfig configures the outlier detection wrapper. Zero values
+// are replaced by the defaults.
+type OutlierDetectionConfig struct {
+	// Interval is the time between two analyses of the failure rates, which
+	// is also when ejected SubConns are returned.
+	Interval time.Duration
+	// BaseEjectionTime is how long a SubConn is ejected the first time. Each
+	// further ejection doubles it, up to MaxEjectionTime.
+	BaseEjectionTime time.Duration
+	MaxEjectionTime  time.Duration
+	// MaxEjectionPercent is the maximum percentage of SubConns ejected at
+	// the same time.
+	MaxEjectionPercent int
+	// ConsecutiveFailures is the number of consecutive failures that ejects a
+	// SubConn.
+	ConsecutiveFailures int
+	// SuccessRateStdevFactor ejects the SubConns whose success rate is below
+	// mean - stdev*SuccessRateStdevFactor of all SubConns in an interval.
+	SuccessRateStdevFactor float64
+	// SuccessRateMinimumHosts is the number of SubConns that must have at
+	// least SuccessRateRequestVolume requests in an interval for the success
+	// rate analysis to run.
+	SuccessRateMinimumHosts  int
+	SuccessRateRequestVolume int
+}
+
+var DefaultOutlierDetectionConfig = OutlierDetectionConfig{
+	Interval:                 10 * time.Second,
+	BaseEjectionTime:         30 * time.Second,
+	MaxEjectionTime:          300 * time.Second,
+	MaxEjectionPercent:       10,
+	ConsecutiveFailures:      5,
+	SuccessRateStdevFactor:   1.9,
+	SuccessRateMinimumHosts:  5,
+	SuccessRateRequestVolume: 100,
+}
+
+func (c OutlierDetectionConfig) withDefaults() OutlierDetectionConfig {
+	d := DefaultOutlierDetectionConfig
+	if c.Interval <= 0 {
+		c.Interval = d.Interval
+	}
+	if c.BaseEjectionTime <= 0 {
+		c.BaseEjectionTime = d.BaseEjectionTime
+	}
+	if c.MaxEjectionTime <= 0 {
+		c.MaxEjectionTime = d.MaxEjectionTime
+	}
+	if c.MaxEjectionPercent <= 0 {
+		c.MaxEjectionPercent = d.MaxEjectionPercent
+	}
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = d.ConsecutiveFailures
+	}
+	if c.SuccessRateStdevFactor <= 0 {
+		c.SuccessRateStdevFactor = d.SuccessRateStdevFactor
+	}
+	if c.SuccessRateMinimumHosts <= 0 {
+		c.SuccessRateMinimumHosts = d.SuccessRateMinimumHosts
+	}
+	if c.SuccessRateRequestVolume <= 0 {
+		c.SuccessRateRequestVolume = d.SuccessRateRequestVolume
+	}
+	return c
+}
+
+// OutlierDetectionName returns the name the outlier detection wrapper of the
+// child balancer is registered under.
+func OutlierDetectionName(child string) string {
+	return OutlierDetection + "_" + child
+}
+
+// InitOutlierDetectionBuilder registers a balancer named
+// OutlierDetectionName(child) that wraps the child balancer and ejects its
+// SubConns that fail too often.
+func InitOutlierDetectionBuilder(child string, config OutlierDetectionConfig) {
+	balancer.Register(newOutlierDetectionBuilder(child, config))
+}
+
+// newOutlierDetectionBuilder creates a new outlier detection balancer builder.
+func newOutlierDetectionBuilder(child string, config OutlierDetectionConfig) balancer.Builder {
+	config = config.withDefaults()
+	return &wrapperBuilder{
+		name:  OutlierDetectionName(child),
+		child: child,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return newOutlierDetector(b, config)
+		},
+	}
+}
+
+// isServerFailure reports whether err is the gRPC equivalent of a 5xx.
+func isServerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// isCanceled reports whether the caller canceled the request, which tells
+// nothing about the server.
+func isCanceled(err error) bool {
+	return status.Code(err) == codes.Canceled
+}
+
+type outlierHost struct {
+	sc          balancer.SubConn
+	successes   int64
+	failures    int64
+	consecutive int
+	ejections   int // number of ejections, decreased while healthy
+	ejectedAt   time.Time
+	ejected     bool
+}
+
+type outlierDetector struct {
+	b      *wrapperBalancer
+	config OutlierDetectionConfig
+
+	mu    sync.Mutex
+	hosts map[balancer.SubConn]*outlierHost
+
+	done chan struct{}
+}
+
+func newOutlierDetector(b *wrapperBalancer, config OutlierDetectionConfig) *outlierDetector {
+	d := &outlierDetector{
+		b:      b,
+		config: config,
+		hosts:  make(map[balancer.SubConn]*outlierHost),
+		done:   make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+func (d *outlierDetector) addSubConn(sc balancer.SubConn) {
+	d.mu.Lock()
+	d.hosts[sc] = &outlierHost{sc: sc}
+	d.mu.Unlock()
+}
+
+func (d *outlierDetector) removeSubConn(sc balancer.SubConn) {
+	d.mu.Lock()
+	delete(d.hosts, sc)
+	d.mu.Unlock()
+}
+
+func (d *outlierDetector) updateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+}
+
+func (d *outlierDetector) wrapPicker(picker balancer.Picker) balancer.Picker {
+	return &outlierDetectionPicker{picker: picker, d: d}
+}
+
+func (d *outlierDetector) close() {
+	close(d.done)
+}
+
+func (d *outlierDetector) run() {
+	ticker := time.NewTicker(d.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.sweep()
+		}
+	}
+}
+
+// record counts the result of an RPC and ejects the host when it reached the
+// consecutive failure threshold. A canceled RPC is neither a success nor a
+// failure.
+func (d *outlierDetector) record(sc balancer.SubConn, err error) {
+	if isCanceled(err) {
+		return
+	}
+	d.mu.Lock()
+	host, ok := d.hosts[sc]
+	if !ok {
+		d.mu.Unlock()
+		return
+	}
+	eject := false
+	if isServerFailure(err) {
+		host.failures++
+		host.consecutive++
+		if host.consecutive >= d.config.ConsecutiveFailures {
+			eject = d.ejectLocked(host, time.Now())
+		}
+	} else {
+		host.successes++
+		host.consecutive = 0
+	}
+	d.mu.Unlock()
+
+	if eject {
+		d.b.hide(sc)
+	}
+}
+
+// ejectLocked marks host ejected if the maximum ejection percentage allows
+// it. d.mu must be held.
+func (d *outlierDetector) ejectLocked(host *outlierHost, now time.Time) bool {
+	if host.ejected {
+		return false
+	}
+	ejected := 0
+	for _, h := range d.hosts {
+		if h.ejected {
+			ejected++
+		}
+	}
+	if ejected*100 >= d.config.MaxEjectionPercent*len(d.hosts) {
+		return false
+	}
+	host.ejected = true
+	host.ejectedAt = now
+	host.ejections++
+	host.consecutive = 0
+	return true
+}
+
+func (d *outlierDetector) ejectionTime(host *outlierHost) time.Duration {
+	t := d.config.BaseEjectionTime
+	for i := 1; i < host.ejections && t < d.config.MaxEjectionTime; i++ {
+		t *= 2
+	}
+	if t > d.config.MaxEjectionTime {
+		t = d.config.MaxEjectionTime
+	}
+	return t
+}
+
+// sweep runs once per interval: it returns the hosts whose ejection time is
+// over, ejects the success rate outliers and resets the counters.
+func (d *outlierDetector) sweep() {
+	now := time.Now()
+	var eject, uneject []balancer.SubConn
+
+	d.mu.Lock()
+	for _, host := range d.hosts {
+		if host.ejected {
+			if now.Sub(host.ejectedAt) >= d.ejectionTime(host) {
+				host.ejected = false
+				uneject = append(uneject, host.sc)
+			}
+		} else if host.ejections > 0 && host.failures == 0 {
+			host.ejections--
+		}
+	}
+
+	var candidates []*outlierHost
+	var sum float64
+	for _, host := range d.hosts {
+		if !host.ejected && host.successes+host.failures >= int64(d.config.SuccessRateRequestVolume) {
+			candidates = append(candidates, host)
+			sum += host.successRate()
+		}
+	}
+	if len(candidates) >= d.config.SuccessRateMinimumHosts {
+		mean := sum / float64(len(candidates))
+		var variance float64
+		for _, host := range candidates {
+			variance += (host.successRate() - mean) * (host.successRate() - mean)
+		}
+		stdev := math.Sqrt(variance / float64(len(candidates)))
+		threshold := mean - stdev*d.config.SuccessRateStdevFactor
+		for _, host := range candidates {
+			if host.successRate() < threshold && d.ejectLocked(host, now) {
+				eject = append(eject, host.sc)
+			}
+		}
+	}
+
+	for _, host := range d.hosts {
+		host.successes = 0
+		host.failures = 0
+	}
+	d.mu.Unlock()
+
+	for _, sc := range uneject {
+		d.b.show(sc)
+	}
+	for _, sc := range eject {
+		d.b.hide(sc)
+	}
+}
+
+func (h *outlierHost) successRate() float64 {
+	return float64(h.successes) / float64(h.successes+h.failures)
+}
+
+type outlierDetectionPicker struct {
+	picker balancer.Picker
+	d      *outlierDetector
+}
+
+func (p *outlierDetectionPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	ret, err := p.picker.Pick(info)
+	if err != nil || ret.SubConn == nil {
+		return ret, err
+	}
+	return p.track(ret), nil
+}
+
+func (p *outlierDetectionPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return p.track(pickSubConn(p.picker, info, sc)), true
+}
+
+// track wraps Done to record the result of the request.
+func (p *outlierDetectionPicker) track(ret balancer.PickResult) balancer.PickResult {
+	sc := ret.SubConn
+	done := ret.Done
+	ret.Done = func(info balancer.DoneInfo) {
+		if !isDroppedPick(info.Err) {
+			p.d.record(sc, info.Err)
+		}
+		if done != nil {
+			done(info)
+		}
+	}
+	return ret
+}
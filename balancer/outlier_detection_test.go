@@ -0,0 +1,131 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+var (
+	errTestUnavailable = status.Error(codes.Unavailable, "test failure")
+	errTestCanceled    = status.Error(codes.Canceled, "test canceled")
+)
+
+func newTestOutlierDetector(t *testing.T, config OutlierDetectionConfig, n int) (*testClientConn, *wrapperBalancer, *outlierDetector) {
+	// sweeps are called by the tests
+	config.Interval = time.Hour
+	cc, b := newTestWrapper(t, newOutlierDetectionBuilder(RoundRobin, config), n)
+	return cc, b, b.wrapper.(*outlierDetector)
+}
+
+// fail picks n times and fails every call.
+func (cc *testClientConn) fail(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		ret, err := cc.pick(context.Background())
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		ret.Done(balancer.DoneInfo{Err: errTestUnavailable})
+	}
+}
+
+func (d *outlierDetector) ejected() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ejected := 0
+	for _, host := range d.hosts {
+		if host.ejected {
+			ejected++
+		}
+	}
+	return ejected
+}
+
+func TestOutlierDetectionMaxEjectionPercent(t *testing.T) {
+	cc, b, d := newTestOutlierDetector(t, OutlierDetectionConfig{
+		MaxEjectionPercent:  20,
+		ConsecutiveFailures: 2,
+	}, 10)
+	defer b.Close()
+
+	cc.fail(t, 100)
+	if got := d.ejected(); got != 2 {
+		t.Fatalf("%d of 10 SubConns ejected, want 2", got)
+	}
+	if picked := cc.picked(t, 80); len(picked) != 8 {
+		t.Fatalf("picks after ejecting 2 of 10 SubConns = %v", picked)
+	}
+}
+
+func TestOutlierDetectionEjectionBackoff(t *testing.T) {
+	cc, b, d := newTestOutlierDetector(t, OutlierDetectionConfig{
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     3 * time.Minute,
+		MaxEjectionPercent:  100,
+		ConsecutiveFailures: 1,
+	}, 2)
+	defer b.Close()
+	sc := cc.subConns[0]
+	host := d.hosts[sc]
+	// ejectedFor moves the ejection time of host back by ejected
+	ejectedFor := func(ejected time.Duration) {
+		d.mu.Lock()
+		host.ejectedAt = time.Now().Add(-ejected)
+		d.mu.Unlock()
+	}
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		d.record(sc, errTestUnavailable)
+		if !host.ejected {
+			t.Fatalf("ejection %d: SubConn not ejected", i+1)
+		}
+		if got := d.ejectionTime(host); got != want {
+			t.Fatalf("ejection %d: ejection time %v, want %v", i+1, got, want)
+		}
+
+		ejectedFor(want - time.Second)
+		d.sweep()
+		if !host.ejected || len(cc.picked(t, 10)) != 1 {
+			t.Fatalf("ejection %d: SubConn returned before its ejection time", i+1)
+		}
+		ejectedFor(want)
+		d.sweep()
+		if host.ejected || len(cc.picked(t, 10)) != 2 {
+			t.Fatalf("ejection %d: SubConn not returned after its ejection time", i+1)
+		}
+	}
+
+	// every interval without failures takes one of the 4 ejections back
+	for i := 0; i < 3; i++ {
+		d.sweep()
+	}
+	d.record(sc, errTestUnavailable)
+	if got := d.ejectionTime(host); got != 2*time.Minute {
+		t.Fatalf("ejection time after three healthy intervals %v, want 2m", got)
+	}
+}
+
+func TestOutlierDetectionCanceled(t *testing.T) {
+	cc, b, d := newTestOutlierDetector(t, OutlierDetectionConfig{
+		MaxEjectionPercent:  100,
+		ConsecutiveFailures: 2,
+	}, 2)
+	defer b.Close()
+	sc := cc.subConns[0]
+	host := d.hosts[sc]
+
+	// a canceled call neither breaks the run of failures nor counts as one
+	d.record(sc, errTestUnavailable)
+	d.record(sc, errTestCanceled)
+	if host.ejected || host.successes != 0 || host.failures != 1 {
+		t.Fatalf("after a failure and a canceled call: ejected %v, %d successes, %d failures", host.ejected, host.successes, host.failures)
+	}
+	d.record(sc, errTestUnavailable)
+	if !host.ejected {
+		t.Fatal("SubConn not ejected after 2 failures around a canceled call")
+	}
+}
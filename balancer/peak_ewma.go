@@ -0,0 +1,196 @@
+package balancer
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const PeakEwma = "peak_ewma_x"
+
+const (
+	// DefaultEwmaDecay is the time constant of the latency moving average.
+	DefaultEwmaDecay = 10 * time.Second
+	// ewmaPenalty is the latency assumed for a node that has requests in flight
+	// but no latency observation yet.
+	ewmaPenalty = float64(time.Second)
+)
+
+// peakEwmaLBConfig is the service config of peak_ewma_x, e.g.
+// {"choice_count": 2, "decay": "10s"}.
+type peakEwmaLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	ChoiceCount int      `json:"choice_count,omitempty"`
+	Decay       duration `json:"decay,omitempty"`
+}
+
+// newPeakEwmaBuilder creates a new peakEwma balancer builder.
+func newPeakEwmaBuilder() balancer.Builder {
+	return &configBuilder{
+		name: PeakEwma,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			return parseLBConfig(PeakEwma, js, &peakEwmaLBConfig{})
+		},
+		newPickerBuilder: func(config serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			b := &peakEwmaPickerBuilder{
+				decay:   DefaultEwmaDecay,
+				choices: DefaultChoiceCount,
+				nodes:   make(map[balancer.SubConn]*ewmaNode),
+			}
+			if c, ok := config.(*peakEwmaLBConfig); ok {
+				if c.ChoiceCount > 0 {
+					b.choices = c.ChoiceCount
+				}
+				if c.Decay > 0 {
+					b.decay = time.Duration(c.Decay)
+				}
+			}
+			return b
+		},
+	}
+}
+
+func init() {
+	balancer.Register(newPeakEwmaBuilder())
+}
+
+// peakEwmaPickerBuilder keeps the nodes of the ready SubConns across pickers,
+// so that a rebuild keeps their latency averages and in-flight requests.
+type peakEwmaPickerBuilder struct {
+	decay   time.Duration
+	choices int
+	nodes   map[balancer.SubConn]*ewmaNode
+}
+
+func (b *peakEwmaPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("peakEwmaPicker: newPicker called with buildInfo: %v", buildInfo)
+
+	for sc := range b.nodes {
+		if _, ok := buildInfo.ReadySCs[sc]; !ok {
+			delete(b.nodes, sc)
+		}
+	}
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	var nodes []*ewmaNode
+	for subConn := range buildInfo.ReadySCs {
+		node, ok := b.nodes[subConn]
+		if !ok {
+			node = &ewmaNode{
+				subConn: subConn,
+				decay:   float64(b.decay),
+			}
+			node.state.Store(ewmaState{stamp: time.Now().UnixNano()})
+			b.nodes[subConn] = node
+		}
+		nodes = append(nodes, node)
+	}
+
+	choices := b.choices
+	if choices <= 0 {
+		choices = DefaultChoiceCount
+	}
+	return &peakEwmaPicker{
+		nodes:   nodes,
+		choices: choices,
+	}
+}
+
+// ewmaNode tracks a peak-sensitive exponentially weighted moving average of
+// the round-trip latency of a SubConn. A latency above the current average
+// replaces it immediately, lower latencies are decayed in. Picks read the
+// state without locking, only responses update it.
+type ewmaNode struct {
+	subConn  balancer.SubConn
+	inflight int64
+	decay    float64
+
+	mu    sync.Mutex   // serializes observe
+	state atomic.Value // ewmaState
+}
+
+type ewmaState struct {
+	cost  float64 // nanoseconds
+	stamp int64   // unix nanoseconds of the last update
+}
+
+func (n *ewmaNode) observe(rtt float64) {
+	now := time.Now().UnixNano()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s := n.state.Load().(ewmaState)
+	if rtt > s.cost {
+		s.cost = rtt
+	} else {
+		w := math.Exp(-math.Max(float64(now-s.stamp), 0) / n.decay)
+		s.cost = s.cost*w + rtt*(1-w)
+	}
+	s.stamp = now
+	n.state.Store(s)
+}
+
+// load returns the current latency estimate multiplied by the number of
+// in-flight requests plus one.
+func (n *ewmaNode) load() float64 {
+	inflight := atomic.LoadInt64(&n.inflight)
+
+	// let the average decay towards zero while no responses arrive
+	s := n.state.Load().(ewmaState)
+	td := math.Max(float64(time.Now().UnixNano()-s.stamp), 0)
+	cost := s.cost * math.Exp(-td/n.decay)
+
+	if cost == 0 && inflight != 0 {
+		return ewmaPenalty + float64(inflight)
+	}
+	return cost * float64(inflight+1)
+}
+
+type peakEwmaPicker struct {
+	nodes   []*ewmaNode
+	choices int
+}
+
+func (p *peakEwmaPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	ret := balancer.PickResult{}
+	if len(p.nodes) == 0 {
+		return ret, balancer.ErrNoSubConnAvailable
+	}
+	node := p.nodes[chooseLeast(len(p.nodes), p.choices, func(i int) float64 {
+		return p.nodes[i].load()
+	})]
+	return p.track(node), nil
+}
+
+func (p *peakEwmaPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	for _, node := range p.nodes {
+		if node.subConn == sc {
+			return p.track(node), true
+		}
+	}
+	return balancer.PickResult{}, false
+}
+
+// track counts a request to node until Done, which observes its latency.
+func (p *peakEwmaPicker) track(node *ewmaNode) balancer.PickResult {
+	atomic.AddInt64(&node.inflight, 1)
+	start := time.Now()
+	return balancer.PickResult{
+		SubConn: node.subConn,
+		Done: func(info balancer.DoneInfo) {
+			atomic.AddInt64(&node.inflight, -1)
+			if !isDroppedPick(info.Err) {
+				node.observe(float64(time.Since(start)))
+			}
+		},
+	}
+}
@@ -0,0 +1,42 @@
+package balancer
+
+import (
+	"google.golang.org/grpc/balancer"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPeakEwmaRebuild(t *testing.T) {
+	b := benchPickerBuilder(newPeakEwmaBuilder()).(*peakEwmaPickerBuilder)
+	info := benchBuildInfo(3)
+	var scs []balancer.SubConn
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+	sc, removed := scs[0], scs[1]
+
+	p := b.Build(info).(*peakEwmaPicker)
+	slow, _ := p.pickSubConn(balancer.PickInfo{}, sc)
+	time.Sleep(time.Millisecond)
+	slow.Done(balancer.DoneInfo{})
+	inflight, _ := p.pickSubConn(balancer.PickInfo{}, sc)
+
+	// another SubConn goes away, sc keeps its latency and in-flight request
+	delete(info.ReadySCs, removed)
+	p = b.Build(info).(*peakEwmaPicker)
+	node := b.nodes[sc]
+	if node == nil || node.state.Load().(ewmaState).cost < float64(time.Millisecond) {
+		t.Fatalf("latency of %v forgotten by the rebuild", sc)
+	}
+	if got := atomic.LoadInt64(&node.inflight); got != 1 {
+		t.Fatalf("%d requests in flight on %v after the rebuild, want 1", got, sc)
+	}
+	inflight.Done(balancer.DoneInfo{})
+	if got := atomic.LoadInt64(&node.inflight); got != 0 {
+		t.Fatalf("%d requests in flight on %v after Done, want 0", got, sc)
+	}
+	if _, ok := b.nodes[removed]; ok || len(p.nodes) != 2 {
+		t.Fatalf("builder keeps %d nodes and the picker %d, want the 2 ready ones", len(b.nodes), len(p.nodes))
+	}
+}
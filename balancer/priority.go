@@ -0,0 +1,182 @@
+package balancer
+
+import (
+	"encoding/json"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+	"reflect"
+	"sort"
+)
+
+const Priority = "priority_x"
+
+// PriorityConfig configures the priority_x balancer. The percentages are of
+// the resolved instances of a priority group that are ready.
+type PriorityConfig struct {
+	// FailoverPercent is the healthy capacity below which the traffic leaves
+	// the active group for the next priority.
+	FailoverPercent int
+	// FailbackPercent is the healthy capacity a higher priority group needs
+	// to get the traffic back. It is at least FailoverPercent, so that a
+	// group around the threshold does not flap.
+	FailbackPercent int
+}
+
+var DefaultPriorityConfig = PriorityConfig{
+	FailoverPercent: 70,
+	FailbackPercent: 90,
+}
+
+func (c PriorityConfig) withDefaults() PriorityConfig {
+	if c.FailoverPercent <= 0 || c.FailoverPercent > 100 {
+		c.FailoverPercent = DefaultPriorityConfig.FailoverPercent
+	}
+	if c.FailbackPercent < c.FailoverPercent {
+		c.FailbackPercent = c.FailoverPercent
+	}
+	if c.FailbackPercent > 100 {
+		c.FailbackPercent = 100
+	}
+	return c
+}
+
+// InitPriorityBuilder registers priority_x again with config.
+func InitPriorityBuilder(config PriorityConfig) {
+	balancer.Register(newPriorityBuilder(config))
+}
+
+// newPriorityBuilder creates a new priority balancer builder.
+func newPriorityBuilder(config PriorityConfig) balancer.Builder {
+	return &priorityBuilder{config: config.withDefaults()}
+}
+
+func init() {
+	balancer.Register(newPriorityBuilder(DefaultPriorityConfig))
+}
+
+type priorityBuilder struct {
+	config PriorityConfig
+}
+
+func (b *priorityBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	lb := &priorityBalancer{defaults: b.config, config: b.config}
+	lb.pb = &rebuildingPickerBuilder{newPicker: (&priorityPickerBuilder{lb: lb, active: -1}).build}
+	lb.Balancer = base.NewBalancerBuilder(Priority, lb.pb, base.Config{HealthCheck: true}).Build(cc, opts)
+	return lb
+}
+
+func (b *priorityBuilder) Name() string {
+	return Priority
+}
+
+// priorityLBConfig is the service config of priority_x, e.g.
+// {"failover_percent": 70, "failback_percent": 90}.
+type priorityLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	FailoverPercent int `json:"failover_percent,omitempty"`
+	FailbackPercent int `json:"failback_percent,omitempty"`
+}
+
+func (b *priorityBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseLBConfig(Priority, js, &priorityLBConfig{})
+}
+
+// priorityBalancer counts the resolved addresses of every priority, which
+// the picker builder compares to the ready SubConns.
+type priorityBalancer struct {
+	balancer.Balancer
+	pb       *rebuildingPickerBuilder
+	defaults PriorityConfig
+	config   PriorityConfig
+	totals   map[int]int
+}
+
+func (lb *priorityBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	config := lb.config
+	if lbc, ok := s.BalancerConfig.(*priorityLBConfig); ok {
+		config = lb.defaults
+		if lbc.FailoverPercent > 0 {
+			config.FailoverPercent = lbc.FailoverPercent
+		}
+		if lbc.FailbackPercent > 0 {
+			config.FailbackPercent = lbc.FailbackPercent
+		}
+		config = config.withDefaults()
+	}
+	totals := make(map[int]int)
+	for _, addr := range s.ResolverState.Addresses {
+		totals[common.GetPriority(addr)]++
+	}
+	// the active priority may change with the config or the totals
+	if config != lb.config || !reflect.DeepEqual(totals, lb.totals) {
+		lb.config = config
+		lb.totals = totals
+		lb.pb.rebuild()
+	}
+	return lb.Balancer.UpdateClientConnState(s)
+}
+
+// priorityPickerBuilder picks round robin from the highest priority group
+// with enough healthy capacity.
+type priorityPickerBuilder struct {
+	lb *priorityBalancer
+	// active is the priority that got the traffic from the last picker, -1
+	// before the first one
+	active int
+}
+
+func (b *priorityPickerBuilder) build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("priorityPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	groups := make(map[int]base.PickerBuildInfo)
+	for sc, info := range buildInfo.ReadySCs {
+		priority := common.GetPriority(info.Address)
+		group, ok := groups[priority]
+		if !ok {
+			group = base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+			groups[priority] = group
+		}
+		group.ReadySCs[sc] = info
+	}
+	var priorities []int
+	for priority := range groups {
+		priorities = append(priorities, priority)
+	}
+	sort.Ints(priorities)
+
+	active := -1
+	for _, priority := range priorities {
+		threshold := b.lb.config.FailoverPercent
+		if b.active >= 0 && priority < b.active {
+			threshold = b.lb.config.FailbackPercent
+		}
+		if b.healthyPercent(priority, len(groups[priority].ReadySCs)) >= threshold {
+			active = priority
+			break
+		}
+	}
+	if active < 0 {
+		// no group has enough capacity, use the highest priority left
+		active = priorities[0]
+	}
+	if active != b.active {
+		grpclog.Infof("priorityPicker: switching from priority %d to %d", b.active, active)
+		b.active = active
+	}
+	return (&roundRobinPickerBuilder{}).Build(groups[active])
+}
+
+func (b *priorityPickerBuilder) healthyPercent(priority, ready int) int {
+	total := b.lb.totals[priority]
+	if total < ready {
+		total = ready
+	}
+	return ready * 100 / total
+}
@@ -0,0 +1,63 @@
+package balancer
+
+import (
+	"fmt"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"testing"
+)
+
+func TestPriorityHysteresis(t *testing.T) {
+	cc := &testClientConn{}
+	b := newPriorityBuilder(DefaultPriorityConfig).Build(cc, balancer.BuildOptions{})
+	defer b.Close()
+	var addrs []resolver.Address
+	for priority := 0; priority < 2; priority++ {
+		for i := 0; i < 10; i++ {
+			md := metadata.Pairs(common.PriorityKey, fmt.Sprint(priority))
+			addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.%d.%d:8080", priority, i), Metadata: &md})
+		}
+	}
+	if err := b.UpdateClientConnState(balancer.ClientConnState{ResolverState: resolver.State{Addresses: addrs}}); err != nil {
+		t.Fatal(err)
+	}
+	// base creates the SubConns in the order of the addresses
+	primary := make(map[balancer.SubConn]bool)
+	for i, sc := range cc.subConns {
+		primary[sc] = i < 10
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Connecting})
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+	// setReady makes the first n primary SubConns ready and the others fail
+	setReady := func(n int) {
+		for i, sc := range cc.subConns[:10] {
+			state := connectivity.TransientFailure
+			if i < n {
+				state = connectivity.Ready
+			}
+			b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: state})
+		}
+	}
+
+	// down through the failover threshold of 70%, up through the failback
+	// threshold of 90% and down again
+	steps := []struct {
+		ready   int
+		primary bool
+	}{
+		{10, true}, {8, true}, {7, true}, {6, false},
+		{7, false}, {8, false}, {9, true},
+		{8, true}, {7, true}, {6, false}, {10, true},
+	}
+	for _, step := range steps {
+		setReady(step.ready)
+		for sc, n := range cc.picked(t, 40) {
+			if primary[sc] != step.primary {
+				t.Fatalf("%d0%% of the primary ready: %d picks to %v, want primary %v", step.ready, n, sc, step.primary)
+			}
+		}
+	}
+}
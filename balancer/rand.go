@@ -0,0 +1,32 @@
+package balancer
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var randSeed = time.Now().UnixNano()
+
+// randPool keeps a random source per P, so that concurrent picks never
+// contend on the lock of a shared source.
+var randPool = sync.Pool{
+	New: func() interface{} {
+		return rand.New(rand.NewSource(atomic.AddInt64(&randSeed, 1)))
+	},
+}
+
+func randIntn(n int) int {
+	r := randPool.Get().(*rand.Rand)
+	v := r.Intn(n)
+	randPool.Put(r)
+	return v
+}
+
+func randFloat64() float64 {
+	r := randPool.Get().(*rand.Rand)
+	v := r.Float64()
+	randPool.Put(r)
+	return v
+}
@@ -5,8 +5,6 @@ import (
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 	"google.golang.org/grpc/grpclog"
-	"math/rand"
-	"sync"
 	"time"
 )
 
@@ -14,44 +12,87 @@ const Random = "random_x"
 
 // newRandomBuilder creates a new random balancer builder.
 func newRandomBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(Random, &randomPickerBuilder{}, base.Config{HealthCheck: true})
+	return newSlowStartPolicyBuilder(Random, nil, func(s *slowStart) base.PickerBuilder {
+		return &randomPickerBuilder{slowStart: s}
+	})
 }
 
 func init() {
 	balancer.Register(newRandomBuilder())
 }
 
-type randomPickerBuilder struct{}
+type randomPickerBuilder struct {
+	slowStart *slowStart
+}
 
-func (*randomPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+func (b *randomPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	grpclog.Infof("randomPicker: newPicker called with buildInfo: %v", buildInfo)
 	if len(buildInfo.ReadySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 	var scs []balancer.SubConn
+	var nodes []*weightedNode
 
 	for subCon, subConnInfo := range buildInfo.ReadySCs {
 		weight := common.GetWeight(subConnInfo.Address)
 		for i := 0; i < weight; i++ {
 			scs = append(scs, subCon)
 		}
+		if weight > 0 {
+			nodes = append(nodes, &weightedNode{subConn: subCon, weight: weight})
+		}
+	}
+	if len(scs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
-	return &randomPicker{
+	picker := &randomPicker{
 		subConns: scs,
-		rand:     rand.New(rand.NewSource(time.Now().Unix())),
 	}
+	if b.slowStart != nil {
+		picker.slowStart = b.slowStart
+		picker.warmUntil = b.slowStart.update(buildInfo)
+		for _, node := range nodes {
+			node.readySince = b.slowStart.readySince[node.subConn]
+		}
+		picker.nodes = nodes
+	}
+	return picker
 }
 
 type randomPicker struct {
 	subConns []balancer.SubConn
-	mu       sync.Mutex
-	rand     *rand.Rand
+
+	// nodes are picked by their ramped up weight until warmUntil
+	slowStart *slowStart
+	warmUntil time.Time
+	nodes     []*weightedNode
 }
 
 func (p *randomPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	ret := balancer.PickResult{}
-	p.mu.Lock()
-	ret.SubConn = p.subConns[p.rand.Intn(len(p.subConns))]
-	p.mu.Unlock()
+	if p.slowStart != nil {
+		if now := time.Now(); now.Before(p.warmUntil) {
+			ret.SubConn = p.pickWarming(now)
+			return ret, nil
+		}
+	}
+	ret.SubConn = p.subConns[randIntn(len(p.subConns))]
 	return ret, nil
 }
+
+func (p *randomPicker) pickWarming(now time.Time) balancer.SubConn {
+	weights := make([]float64, len(p.nodes))
+	total := 0.0
+	for i, node := range p.nodes {
+		weights[i] = float64(node.weight) * p.slowStart.factor(node.readySince, now)
+		total += weights[i]
+	}
+	r := randFloat64() * total
+	for i, w := range weights {
+		if r < w {
+			return p.nodes[i].subConn
+		}
+		r -= w
+	}
+	return p.nodes[len(p.nodes)-1].subConn
+}
@@ -0,0 +1,247 @@
+package balancer
+
+import (
+	"context"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const RendezvousHash = "rendezvous_x"
+
+type rendezvousRankKey struct{}
+
+// WithRendezvousRank returns a context that makes the rendezvous_x picker
+// choose the candidate with the given rank for the hash key instead of the
+// best one. Rank 0 is the best candidate, rank 1 the second choice and so on,
+// which lets a caller retry on another node when the first one fails.
+func WithRendezvousRank(ctx context.Context, rank int) context.Context {
+	return context.WithValue(ctx, rendezvousRankKey{}, rank)
+}
+
+func init() {
+	balancer.Register(NewRendezvousBuilder(RendezvousHash, DefaultConsistentHashKey))
+}
+
+func InitRendezvousBuilder(consistentHashKey string, opts ...ConsistentHashOption) {
+	balancer.Register(NewRendezvousBuilder(RendezvousHash, consistentHashKey, opts...))
+}
+
+// NewRendezvousBuilder creates a rendezvous hash balancer builder named name, see
+// NewConsistentHashBuilder.
+func NewRendezvousBuilder(name, consistentHashKey string, opts ...ConsistentHashOption) balancer.Builder {
+	config := newConsistentHashConfig(name, consistentHashKey, opts)
+	return newHashPolicyBuilder(name, config, func(c consistentHashConfig, lbc *hashLBConfig) base.PickerBuilder {
+		return &rendezvousPickerBuilder{c}
+	})
+}
+
+type rendezvousPickerBuilder struct {
+	consistentHashConfig
+}
+
+func (b *rendezvousPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("rendezvousPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &rendezvousPicker{
+		subConns:     make(map[string]balancer.SubConn),
+		hash:         NewRendezvous(),
+		keyExtractor: b.keyExtractor,
+		fallback:     newFallbackPicker(b.fallback, b.fallbacks, buildInfo),
+	}
+	for sc, conInfo := range buildInfo.ReadySCs {
+		weight := common.GetWeight(conInfo.Address)
+		if weight <= 0 {
+			continue
+		}
+		picker.hash.Add(conInfo.Address.Addr, weight)
+		picker.subConns[conInfo.Address.Addr] = sc
+	}
+	if len(picker.subConns) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	return picker
+}
+
+type rendezvousPicker struct {
+	subConns     map[string]balancer.SubConn
+	hash         *Rendezvous
+	keyExtractor KeyExtractor
+	fallback     *fallbackPicker
+}
+
+func (p *rendezvousPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var ret balancer.PickResult
+	key, ok := p.keyExtractor(info)
+	if !ok {
+		return p.fallback.Pick(info)
+	}
+	rank, _ := info.Ctx.Value(rendezvousRankKey{}).(int)
+	if rank < 0 {
+		rank = 0
+	}
+	nodes := p.hash.GetN(key, rank+1)
+	if len(nodes) > 0 {
+		// ranks beyond the number of nodes wrap to the last candidate
+		ret.SubConn = p.subConns[nodes[len(nodes)-1]]
+	}
+	return ret, nil
+}
+
+// Rendezvous implements weighted rendezvous (highest random weight) hashing.
+// Each node scores weight / -ln(h) for a key, where h is a uniform hash of the
+// node and the key, and the node with the highest score owns the key. Lookups
+// read an immutable copy of the nodes and never wait for updates.
+type Rendezvous struct {
+	sync.Mutex              // serializes updates
+	nodes      atomic.Value // []rendezvousNode
+}
+
+type rendezvousNode struct {
+	name   string
+	weight float64
+}
+
+func NewRendezvous() *Rendezvous {
+	r := &Rendezvous{}
+	r.nodes.Store([]rendezvousNode(nil))
+	return r
+}
+
+func (r *Rendezvous) load() []rendezvousNode {
+	return r.nodes.Load().([]rendezvousNode)
+}
+
+func (r *Rendezvous) IsEmpty() bool {
+	return len(r.load()) == 0
+}
+
+// Add adds a node with the given weight, or updates the weight of an existing
+// node. Nodes with a weight <= 0 are ignored.
+func (r *Rendezvous) Add(node string, weight int) {
+	if weight <= 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+
+	old := r.load()
+	nodes := make([]rendezvousNode, len(old), len(old)+1)
+	copy(nodes, old)
+	for i := range nodes {
+		if nodes[i].name == node {
+			nodes[i].weight = float64(weight)
+			r.nodes.Store(nodes)
+			return
+		}
+	}
+	r.nodes.Store(append(nodes, rendezvousNode{node, float64(weight)}))
+}
+
+func (r *Rendezvous) Remove(nodes ...string) {
+	r.Lock()
+	defer r.Unlock()
+
+	removed := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		removed[node] = true
+	}
+	old := r.load()
+	kept := make([]rendezvousNode, 0, len(old))
+	for _, node := range old {
+		if !removed[node.name] {
+			kept = append(kept, node)
+		}
+	}
+	r.nodes.Store(kept)
+}
+
+// Get returns the node with the highest score for key.
+func (r *Rendezvous) Get(key string) (string, bool) {
+	nodes := r.load()
+	if len(nodes) == 0 {
+		return "", false
+	}
+	best, bestScore := nodes[0].name, nodes[0].score(key)
+	for _, node := range nodes[1:] {
+		score := node.score(key)
+		if score > bestScore || score == bestScore && node.name < best {
+			best, bestScore = node.name, score
+		}
+	}
+	return best, true
+}
+
+// GetN returns up to n distinct nodes for key, ordered from the highest score
+// to the lowest.
+func (r *Rendezvous) GetN(key string, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	if n == 1 {
+		node, ok := r.Get(key)
+		if !ok {
+			return nil
+		}
+		return []string{node}
+	}
+	nodes := r.load()
+
+	type scored struct {
+		node  string
+		score float64
+	}
+	candidates := make([]scored, 0, len(nodes))
+	for _, node := range nodes {
+		candidates = append(candidates, scored{node.name, node.score(key)})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score == candidates[j].score {
+			return candidates[i].node < candidates[j].node
+		}
+		return candidates[i].score > candidates[j].score
+	})
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	ret := make([]string, n)
+	for i := 0; i < n; i++ {
+		ret[i] = candidates[i].node
+	}
+	return ret
+}
+
+func (n rendezvousNode) score(key string) float64 {
+	x := fnv64a(fnv64a(fnv64a(fnv64Offset, n.name), Salt), key)
+	// FNV mixes the trailing bytes poorly, finish it with the splitmix64
+	// finalizer before mapping the top 53 bits to a float in (0, 1)
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	h := (float64(x>>11) + 0.5) / (1 << 53)
+	return n.weight / -math.Log(h)
+}
+
+const (
+	fnv64Offset = 14695981039346656037
+	fnv64Prime  = 1099511628211
+)
+
+// fnv64a continues the 64 bit FNV-1a hash h with s, like hash/fnv without
+// allocating.
+func fnv64a(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnv64Prime
+	}
+	return h
+}
@@ -0,0 +1,45 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousSkipsZeroWeights(t *testing.T) {
+	buildInfo := func(weights ...int) base.PickerBuildInfo {
+		info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+		for i, weight := range weights {
+			md := metadata.Pairs(common.WeightKey, strconv.Itoa(weight))
+			info.ReadySCs[&testSubConn{id: i}] = base.SubConnInfo{
+				Address: resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:8080", i), Metadata: &md},
+			}
+		}
+		return info
+	}
+	pb := benchPickerBuilder(NewRendezvousBuilder("test_rendezvous_x", DefaultConsistentHashKey))
+
+	picker := pb.Build(buildInfo(0, 1, 0))
+	for i := 0; i < 20; i++ {
+		ctx := context.WithValue(context.Background(), DefaultConsistentHashKey, strconv.Itoa(i))
+		ret, err := picker.Pick(balancer.PickInfo{Ctx: ctx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc, ok := ret.SubConn.(*testSubConn); !ok || sc.id != 1 {
+			t.Fatalf("picked %v, want the only SubConn with a weight", ret.SubConn)
+		}
+	}
+
+	picker = pb.Build(buildInfo(0, -1))
+	ctx := context.WithValue(context.Background(), DefaultConsistentHashKey, "key")
+	if _, err := picker.Pick(balancer.PickInfo{Ctx: ctx}); err != balancer.ErrNoSubConnAvailable {
+		t.Fatalf("pick without weighted SubConns returned %v, want %v", err, balancer.ErrNoSubConnAvailable)
+	}
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryConfig configures the retry interceptor. Zero values are replaced by
+// the defaults.
+type RetryConfig struct {
+	// Methods are the full names of the idempotent methods to retry, all
+	// methods are retried if it is empty.
+	Methods []string
+	// MaxAttempts is the number of attempts at most, the original included.
+	MaxAttempts int
+	// Codes are the status codes that are retried.
+	Codes []codes.Code
+	// The backoff before the n-th retry is a random duration up to
+	// min(InitialBackoff*2^(n-1), MaxBackoff).
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// BudgetPercent is the retry budget: every successful call earns
+	// BudgetPercent/100 of a retry token, every retry spends one. The bucket
+	// holds BudgetTokens tokens at most and starts full.
+	BudgetPercent float64
+	BudgetTokens  float64
+}
+
+var DefaultRetryConfig = RetryConfig{
+	MaxAttempts:    3,
+	Codes:          []codes.Code{codes.Unavailable},
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     time.Second,
+	BudgetPercent:  10,
+	BudgetTokens:   10,
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	d := DefaultRetryConfig
+	if c.MaxAttempts <= 0 {
+		c.MaxAttempts = d.MaxAttempts
+	}
+	if len(c.Codes) == 0 {
+		c.Codes = d.Codes
+	}
+	if c.InitialBackoff <= 0 {
+		c.InitialBackoff = d.InitialBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = d.MaxBackoff
+	}
+	if c.BudgetPercent <= 0 {
+		c.BudgetPercent = d.BudgetPercent
+	}
+	if c.BudgetTokens <= 0 {
+		c.BudgetTokens = d.BudgetTokens
+	}
+	return c
+}
+
+// RetryUnaryClientInterceptor retries failed calls as long as the retry budget
+// allows it. Every retry goes to a SubConn none of the earlier attempts used,
+// so the ClientConn must use a balancer wrapped by InitAttemptBuilder,
+// InitOutlierDetectionBuilder or InitCircuitBreakerBuilder.
+func RetryUnaryClientInterceptor(config RetryConfig) grpc.UnaryClientInterceptor {
+	config = config.withDefaults()
+	r := &retrier{
+		config:  config,
+		methods: make(map[string]bool),
+		codes:   make(map[codes.Code]bool),
+		tokens:  config.BudgetTokens,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, method := range config.Methods {
+		r.methods[method] = true
+	}
+	for _, code := range config.Codes {
+		r.codes[code] = true
+	}
+	return r.intercept
+}
+
+type retrier struct {
+	config  RetryConfig
+	methods map[string]bool
+	codes   map[codes.Code]bool
+
+	mu     sync.Mutex
+	tokens float64
+	rand   *rand.Rand
+}
+
+func (r *retrier) intercept(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if len(r.methods) > 0 && !r.methods[method] {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	if attemptsFromContext(ctx) == nil {
+		ctx = withAttempts(ctx, &attempts{})
+	}
+
+	var lastErr error
+	for n := 1; ; n++ {
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		if err == nil {
+			r.deposit()
+			return nil
+		}
+		if lastErr != nil && isNoAttemptSubConn(err) {
+			// every SubConn failed already, report the real error
+			return lastErr
+		}
+		lastErr = err
+		if n >= r.config.MaxAttempts || !r.codes[status.Code(err)] || !r.withdraw() {
+			return err
+		}
+
+		timer := time.NewTimer(r.backoff(n))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (r *retrier) deposit() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens += r.config.BudgetPercent / 100
+	if r.tokens > r.config.BudgetTokens {
+		r.tokens = r.config.BudgetTokens
+	}
+}
+
+// withdraw takes a token for a retry and reports whether there was one.
+func (r *retrier) withdraw() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+func (r *retrier) backoff(retry int) time.Duration {
+	backoff := r.config.InitialBackoff
+	for i := 1; i < retry && backoff < r.config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > r.config.MaxBackoff {
+		backoff = r.config.MaxBackoff
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return time.Duration(r.rand.Int63n(int64(backoff) + 1))
+}
@@ -0,0 +1,50 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestRetryPicksAnotherSubConn(t *testing.T) {
+	cc, b := newTestAttemptConn(t, 3)
+	defer b.Close()
+
+	var picked []balancer.SubConn
+	failed := status.Error(codes.Unavailable, "test failure")
+	invoker := cc.invoker(func(ctx context.Context, sc balancer.SubConn) error {
+		picked = append(picked, sc)
+		if len(picked) < 3 {
+			return failed
+		}
+		return nil
+	})
+	intercept := RetryUnaryClientInterceptor(RetryConfig{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	})
+
+	if err := intercept(testHashContext(), "/test.Service/Method", nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if len(picked) != 3 || picked[0] == picked[1] || picked[1] == picked[2] || picked[0] == picked[2] {
+		t.Fatalf("attempts picked %v, want three different SubConns", picked)
+	}
+
+	// once every SubConn failed, the call fails with the last real error
+	picked = nil
+	invoker = cc.invoker(func(ctx context.Context, sc balancer.SubConn) error {
+		picked = append(picked, sc)
+		return failed
+	})
+	if err := intercept(testHashContext(), "/test.Service/Method", nil, nil, nil, invoker); err != failed {
+		t.Fatalf("call failed with %v, want %v", err, failed)
+	}
+	if len(picked) != 3 {
+		t.Fatalf("%d attempts on 3 SubConns", len(picked))
+	}
+}
@@ -5,54 +5,260 @@ import (
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
 	"google.golang.org/grpc/grpclog"
-	"math/rand"
-	"sync"
+	"sort"
+	"sync/atomic"
+	"time"
 )
 
 const RoundRobin = "round_robin_x"
 
 // newRoundRobinBuilder creates a new roundrobin balancer builder.
 func newRoundRobinBuilder() balancer.Builder {
-	return base.NewBalancerBuilder(RoundRobin, &roundRobinPickerBuilder{}, base.Config{HealthCheck: true})
+	return newSlowStartPolicyBuilder(RoundRobin, nil, func(s *slowStart) base.PickerBuilder {
+		return &roundRobinPickerBuilder{slowStart: s}
+	})
 }
 
 func init() {
 	balancer.Register(newRoundRobinBuilder())
 }
 
-type roundRobinPickerBuilder struct{}
+type roundRobinPickerBuilder struct {
+	slowStart *slowStart
+}
 
-func (*roundRobinPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+func (b *roundRobinPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
 	grpclog.Infof("roundrobinPicker: newPicker called with buildInfo: %v", buildInfo)
 
 	if len(buildInfo.ReadySCs) == 0 {
 		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
-	var scs []balancer.SubConn
+	var nodes []*weightedNode
 	for subConn, subConnInfo := range buildInfo.ReadySCs {
 		weight := common.GetWeight(subConnInfo.Address)
-		for i := 0; i < weight; i++ {
-			scs = append(scs, subConn)
+		if weight <= 0 {
+			continue
 		}
+		nodes = append(nodes, &weightedNode{
+			subConn:         subConn,
+			weight:          weight,
+			effectiveWeight: int32(weight),
+		})
+	}
+	if len(nodes) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
 	}
 
-	return &roundRobinPicker{
-		subConns: scs,
-		next:     rand.Intn(len(scs)),
+	picker := &roundRobinPicker{
+		nodes:    nodes,
+		schedule: newSchedule(nodes),
+	}
+	if picker.schedule == nil {
+		sum := 0
+		for _, node := range nodes {
+			sum += node.weight
+			picker.cumulative = append(picker.cumulative, sum)
+		}
+	}
+	if b.slowStart != nil {
+		picker.slowStart = b.slowStart
+		picker.warmUntil = b.slowStart.update(buildInfo)
+		for _, node := range nodes {
+			node.readySince = b.slowStart.readySince[node.subConn]
+		}
+		picker.warm.Store(picker.newWarmFactors(time.Now()))
 	}
+	return picker
 }
 
+// weightedNode is a SubConn and its weight in the weighted pickers.
+type weightedNode struct {
+	subConn         balancer.SubConn
+	weight          int
+	effectiveWeight int32 // accessed atomically
+	readySince      time.Time
+}
+
+// roundRobinPicker implements the nginx smooth weighted round robin algorithm:
+// on every pick each node's current weight grows by its weight, the node with
+// the largest current weight is chosen and its current weight is reduced by
+// the total. Picks of one node are spread evenly over a cycle, which is
+// precomputed so that picks only increment an atomic counter.
+//
+// The cycle is only precomputed while it is at most maxScheduleFactor picks
+// per node, so that a picker stays O(n) in the number of nodes whatever their
+// weights. Longer cycles, nodes that lost weight after a failure and nodes
+// that warm up are picked in proportion to their weights instead, following
+// the golden ratio sequence of the counter, which spreads the picks of a node
+// as evenly as the cycle.
 type roundRobinPicker struct {
-	subConns []balancer.SubConn
-	mu       sync.Mutex
-	next     int
+	nodes      []*weightedNode
+	schedule   []*weightedNode // nil if the cycle is too long
+	cumulative []int           // running sums of the weights without schedule
+	index      uint64
+	penalized  int32 // nodes whose effective weight is below their weight
+
+	// the effective weights are ramped up until warmUntil
+	slowStart *slowStart
+	warmUntil time.Time
+	warm      atomic.Value // *warmFactors
+	updating  int32
 }
 
+// warmFactors are the slow start factors of the nodes at updated.
+type warmFactors struct {
+	factors []float64
+	updated time.Time
+}
+
+// warmInterval is how often the picker computes the slow start factors again.
+const warmInterval = 100 * time.Millisecond
+
 func (p *roundRobinPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
-	ret := balancer.PickResult{}
-	p.mu.Lock()
-	ret.SubConn = p.subConns[p.next]
-	p.next = (p.next + 1) % len(p.subConns)
-	p.mu.Unlock()
-	return ret, nil
+	var now time.Time
+	if p.slowStart != nil {
+		now = time.Now()
+	}
+	warming := p.slowStart != nil && now.Before(p.warmUntil)
+	x := atomic.AddUint64(&p.index, 1) - 1
+	if warming || atomic.LoadInt32(&p.penalized) > 0 {
+		return p.track(p.weighted(x, warming, now)), nil
+	}
+	if p.schedule != nil {
+		return p.track(p.schedule[x%uint64(len(p.schedule))]), nil
+	}
+	r := float64((x*goldenRatio64)>>11) / (1 << 53) * float64(p.cumulative[len(p.cumulative)-1])
+	i := sort.Search(len(p.cumulative), func(i int) bool {
+		return float64(p.cumulative[i]) > r
+	})
+	return p.track(p.nodes[i]), nil
+}
+
+func (p *roundRobinPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	for _, node := range p.nodes {
+		if node.subConn == sc {
+			return p.track(node), true
+		}
+	}
+	return balancer.PickResult{}, false
+}
+
+// track returns node with a Done that lowers its weight after a failure.
+func (p *roundRobinPicker) track(node *weightedNode) balancer.PickResult {
+	ret := balancer.PickResult{SubConn: node.subConn}
+	ret.Done = func(info balancer.DoneInfo) {
+		if info.Err == nil || isDroppedPick(info.Err) {
+			return
+		}
+		for {
+			w := atomic.LoadInt32(&node.effectiveWeight)
+			if w <= 1 {
+				return
+			}
+			if atomic.CompareAndSwapInt32(&node.effectiveWeight, w, w-1) {
+				if int(w) == node.weight {
+					atomic.AddInt32(&p.penalized, 1)
+				}
+				return
+			}
+		}
+	}
+	return ret
+}
+
+// weighted chooses the x-th pick in proportion to the effective weights, and
+// gives every penalized node one weight back.
+func (p *roundRobinPicker) weighted(x uint64, warming bool, now time.Time) *weightedNode {
+	var factors []float64
+	if warming {
+		factors = p.warmFactors(now).factors
+	}
+	weight := func(i int) float64 {
+		w := float64(atomic.LoadInt32(&p.nodes[i].effectiveWeight))
+		if factors != nil {
+			w *= factors[i]
+		}
+		return w
+	}
+
+	total := 0.0
+	for i, node := range p.nodes {
+		w := atomic.LoadInt32(&node.effectiveWeight)
+		if int(w) < node.weight && atomic.CompareAndSwapInt32(&node.effectiveWeight, w, w+1) && int(w)+1 == node.weight {
+			atomic.AddInt32(&p.penalized, -1)
+		}
+		total += weight(i)
+	}
+
+	// the weights may have changed since, in which case the last node takes
+	// the rest
+	r := float64((x*goldenRatio64)>>11) / (1 << 53) * total
+	for i, node := range p.nodes {
+		r -= weight(i)
+		if r < 0 {
+			return node
+		}
+	}
+	return p.nodes[len(p.nodes)-1]
+}
+
+// warmFactors returns the current slow start factors, one pick computes them
+// again when they are older than warmInterval while the others keep the old
+// ones.
+func (p *roundRobinPicker) warmFactors(now time.Time) *warmFactors {
+	f := p.warm.Load().(*warmFactors)
+	if now.Sub(f.updated) < warmInterval || !atomic.CompareAndSwapInt32(&p.updating, 0, 1) {
+		return f
+	}
+	f = p.newWarmFactors(now)
+	p.warm.Store(f)
+	atomic.StoreInt32(&p.updating, 0)
+	return f
+}
+
+func (p *roundRobinPicker) newWarmFactors(now time.Time) *warmFactors {
+	f := &warmFactors{factors: make([]float64, len(p.nodes)), updated: now}
+	for i, node := range p.nodes {
+		f.factors[i] = p.slowStart.factor(node.readySince, now)
+	}
+	return f
+}
+
+// maxScheduleFactor bounds the length of a precomputed round robin cycle to
+// this many picks per node.
+const maxScheduleFactor = 8
+
+// newSchedule returns one cycle of the smooth weighted round robin order of
+// nodes, or nil if it is longer than maxScheduleFactor picks per node.
+func newSchedule(nodes []*weightedNode) []*weightedNode {
+	g, sum := 0, 0
+	for _, node := range nodes {
+		g = gcd(g, node.weight)
+		sum += node.weight
+	}
+	size := sum / g
+	if size > maxScheduleFactor*len(nodes) {
+		return nil
+	}
+	current := make([]int, len(nodes))
+	schedule := make([]*weightedNode, size)
+	for i := range schedule {
+		best := 0
+		for j, node := range nodes {
+			current[j] += node.weight / g
+			if current[j] > current[best] {
+				best = j
+			}
+		}
+		current[best] -= size
+		schedule[i] = nodes[best]
+	}
+	return schedule
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
 }
@@ -0,0 +1,42 @@
+package balancer
+
+import (
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestRoundRobinLargeWeights(t *testing.T) {
+	weights := []int{500000, 1}
+	info := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i, weight := range weights {
+		md := metadata.Pairs(common.WeightKey, strconv.Itoa(weight))
+		info.ReadySCs[&testSubConn{id: i}] = base.SubConnInfo{Address: resolver.Address{Metadata: &md}}
+	}
+	p := (&roundRobinPickerBuilder{}).Build(info).(*roundRobinPicker)
+	if p.schedule != nil || len(p.cumulative) != len(weights) {
+		t.Fatalf("picker holds a cycle of %d and %d running sums for 2 nodes", len(p.schedule), len(p.cumulative))
+	}
+
+	const n = 5000000
+	picked := make(map[int]int)
+	for i := 0; i < n; i++ {
+		ret, err := p.Pick(balancer.PickInfo{})
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		picked[ret.SubConn.(*testSubConn).id]++
+	}
+	// the golden ratio sequence spreads the picks evenly over the weights
+	for i, weight := range weights {
+		want := float64(n) * float64(weight) / 500001
+		if math.Abs(float64(picked[i])-want) > 2 {
+			t.Fatalf("picks = %v, want about %.0f for weight %d", picked, want, weight)
+		}
+	}
+}
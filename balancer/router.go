@@ -0,0 +1,353 @@
+package balancer
+
+import (
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const Router = "router_x"
+
+// StringMatch matches a string exactly, by prefix or by regular expression.
+// Exactly one of the fields should be set.
+type StringMatch struct {
+	Exact  string `json:"exact,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	Regex  string `json:"regex,omitempty"`
+
+	re *regexp.Regexp
+}
+
+func (m *StringMatch) compile() error {
+	if m.Regex == "" {
+		return nil
+	}
+	re, err := regexp.Compile(m.Regex)
+	if err != nil {
+		return err
+	}
+	m.re = re
+	return nil
+}
+
+func (m *StringMatch) match(s string) bool {
+	switch {
+	case m.re != nil:
+		return m.re.MatchString(s)
+	case m.Prefix != "":
+		return strings.HasPrefix(s, m.Prefix)
+	default:
+		return s == m.Exact
+	}
+}
+
+// RouteRule sends the requests matching Method and all Headers to the
+// backends whose metadata contains all Labels, using Policy.
+type RouteRule struct {
+	Method  *StringMatch           `json:"method,omitempty"`
+	Headers map[string]StringMatch `json:"headers,omitempty"`
+	Labels  map[string]string      `json:"labels"`
+	// Policy is one of round_robin_x, random_x, least_connection_x and
+	// peak_ewma_x. It defaults to the default policy of the config.
+	Policy string `json:"policy,omitempty"`
+}
+
+// RouterConfig is the JSON configuration of router_x. Requests matching no
+// rule are sent to all backends using DefaultPolicy.
+type RouterConfig struct {
+	DefaultPolicy string      `json:"default_policy,omitempty"`
+	Rules         []RouteRule `json:"rules"`
+}
+
+// routerPolicies are the policies router rules can use for their backends.
+var routerPolicies = map[string]func() base.PickerBuilder{
+	RoundRobin:      func() base.PickerBuilder { return &roundRobinPickerBuilder{} },
+	Random:          func() base.PickerBuilder { return &randomPickerBuilder{} },
+	LeastConnection: func() base.PickerBuilder { return &leastConnectionPickerBuilder{} },
+	PeakEwma:        func() base.PickerBuilder { return &peakEwmaPickerBuilder{decay: DefaultEwmaDecay} },
+}
+
+// ParseRouterConfig parses and validates a JSON router configuration.
+func ParseRouterConfig(data []byte) (*RouterConfig, error) {
+	config := &RouterConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.DefaultPolicy == "" {
+		config.DefaultPolicy = RoundRobin
+	}
+	if _, ok := routerPolicies[config.DefaultPolicy]; !ok {
+		return nil, fmt.Errorf("grpclb: unknown default policy %q", config.DefaultPolicy)
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Policy == "" {
+			rule.Policy = config.DefaultPolicy
+		}
+		if _, ok := routerPolicies[rule.Policy]; !ok {
+			return nil, fmt.Errorf("grpclb: unknown policy %q in rule %d", rule.Policy, i)
+		}
+		if rule.Method != nil {
+			if err := rule.Method.compile(); err != nil {
+				return nil, fmt.Errorf("grpclb: rule %d method: %v", i, err)
+			}
+		}
+		for header, m := range rule.Headers {
+			if err := m.compile(); err != nil {
+				return nil, fmt.Errorf("grpclb: rule %d header %q: %v", i, header, err)
+			}
+			rule.Headers[header] = m
+		}
+	}
+	return config, nil
+}
+
+func (r *RouteRule) match(info balancer.PickInfo) bool {
+	if r.Method != nil && !r.Method.match(info.FullMethodName) {
+		return false
+	}
+	if len(r.Headers) == 0 {
+		return true
+	}
+	md, _ := metadata.FromOutgoingContext(info.Ctx)
+	for header, m := range r.Headers {
+		values := md.Get(header)
+		if len(values) == 0 || !m.match(values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// RouteTable holds the router configuration. It can be reloaded at any time,
+// the pickers use the new rules from the next request on.
+type RouteTable struct {
+	config atomic.Value // *RouterConfig
+}
+
+// NewRouteTable returns a route table without rules, sending every request
+// round robin.
+func NewRouteTable() *RouteTable {
+	t := &RouteTable{}
+	t.config.Store(&RouterConfig{DefaultPolicy: RoundRobin})
+	return t
+}
+
+// Load replaces the configuration with the given JSON. The old one is kept
+// if it is invalid.
+func (t *RouteTable) Load(data []byte) error {
+	config, err := ParseRouterConfig(data)
+	if err != nil {
+		return err
+	}
+	t.config.Store(config)
+	return nil
+}
+
+func (t *RouteTable) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return t.Load(data)
+}
+
+// WatchFile loads the file at path and reloads it whenever its modification
+// time changes, checking every interval, until stop is called.
+func (t *RouteTable) WatchFile(path string, interval time.Duration) (stop func(), err error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.LoadFile(path); err != nil {
+		return nil, err
+	}
+	modTime := fi.ModTime()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				fi, err := os.Stat(path)
+				if err != nil || fi.ModTime().Equal(modTime) {
+					continue
+				}
+				modTime = fi.ModTime()
+				if err := t.LoadFile(path); err != nil {
+					grpclog.Errorf("router: reload %s error: %v", path, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }, nil
+}
+
+func (t *RouteTable) load() *RouterConfig {
+	return t.config.Load().(*RouterConfig)
+}
+
+// routerLBConfig is a RouterConfig given in the service config of a
+// ClientConn, which then ignores the route table of the builder.
+type routerLBConfig struct {
+	serviceconfig.LoadBalancingConfig
+	config *RouterConfig
+}
+
+func init() {
+	balancer.Register(newRouterBuilder(NewRouteTable()))
+}
+
+func InitRouterBuilder(table *RouteTable) {
+	balancer.Register(newRouterBuilder(table))
+}
+
+// newRouterBuilder creates a new router balancer builder.
+func newRouterBuilder(table *RouteTable) balancer.Builder {
+	return &configBuilder{
+		name: Router,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			config, err := ParseRouterConfig(js)
+			if err != nil {
+				return nil, err
+			}
+			return &routerLBConfig{config: config}, nil
+		},
+		newPickerBuilder: func(lbConfig serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			lbc, ok := lbConfig.(*routerLBConfig)
+			if !ok {
+				return &routerPickerBuilder{table}
+			}
+			t := &RouteTable{}
+			t.config.Store(lbc.config)
+			return &routerPickerBuilder{t}
+		},
+	}
+}
+
+type routerPickerBuilder struct {
+	table *RouteTable
+}
+
+func (b *routerPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("routerPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	return &routerPicker{
+		table:     b.table,
+		buildInfo: buildInfo,
+	}
+}
+
+// routerPicker builds the picker of a rule when the rule is first matched and
+// drops them all when the configuration is reloaded. Picks read an immutable
+// copy of the built pickers, only building a new one takes the lock.
+type routerPicker struct {
+	table     *RouteTable
+	buildInfo base.PickerBuildInfo
+
+	mu     sync.Mutex
+	cached atomic.Value // *routerPickers
+}
+
+type routerPickers struct {
+	config  *RouterConfig
+	pickers map[int]balancer.Picker
+}
+
+func (p *routerPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	config := p.table.load()
+	for i := range config.Rules {
+		if config.Rules[i].match(info) {
+			return p.picker(config, i).Pick(info)
+		}
+	}
+	return p.picker(config, -1).Pick(info)
+}
+
+func (p *routerPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return trySubConn(p.picker(p.table.load(), -1), info, sc)
+}
+
+// picker returns the picker of the i-th rule of config, or of the default
+// policy if i is -1.
+func (p *routerPicker) picker(config *RouterConfig, i int) balancer.Picker {
+	if cached, ok := p.cached.Load().(*routerPickers); ok && cached.config == config {
+		if picker, ok := cached.pickers[i]; ok {
+			return picker
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	next := &routerPickers{config: config, pickers: make(map[int]balancer.Picker)}
+	if cached, ok := p.cached.Load().(*routerPickers); ok && cached.config == config {
+		if picker, ok := cached.pickers[i]; ok {
+			return picker
+		}
+		for j, picker := range cached.pickers {
+			next.pickers[j] = picker
+		}
+	}
+	var picker balancer.Picker
+	if i < 0 {
+		picker = routerPolicies[config.DefaultPolicy]().Build(p.buildInfo)
+	} else {
+		picker = p.buildRule(&config.Rules[i], i)
+	}
+	next.pickers[i] = picker
+	p.cached.Store(next)
+	return picker
+}
+
+func (p *routerPicker) buildRule(rule *RouteRule, i int) balancer.Picker {
+	subset := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for sc, info := range p.buildInfo.ReadySCs {
+		var md metadata.MD
+		if m, ok := info.Address.Metadata.(*metadata.MD); ok && m != nil {
+			md = *m
+		}
+		if hasLabels(md, rule.Labels) {
+			subset.ReadySCs[sc] = info
+		}
+	}
+	if len(subset.ReadySCs) == 0 {
+		return base.NewErrPicker(status.Errorf(codes.Unavailable, "grpclb: no ready backend for route rule %d", i))
+	}
+	return routerPolicies[rule.Policy]().Build(subset)
+}
+
+func hasLabels(md metadata.MD, labels map[string]string) bool {
+	for key, value := range labels {
+		found := false
+		for _, v := range md.Get(key) {
+			if v == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package balancer
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/serviceconfig"
+	"math"
+	"time"
+)
+
+// SlowStartConfig configures the slow start of round_robin_x and random_x.
+// During Window after a SubConn becomes ready its weight ramps up from
+// MinWeightPercent of common.GetWeight to the full weight, following
+// (elapsed/Window)^(1/Aggression). Aggression 1 is linear, larger values
+// ramp up faster at the beginning.
+type SlowStartConfig struct {
+	Window           time.Duration
+	Aggression       float64
+	MinWeightPercent float64
+}
+
+var DefaultSlowStartConfig = SlowStartConfig{
+	Window:           30 * time.Second,
+	Aggression:       1,
+	MinWeightPercent: 10,
+}
+
+func (c SlowStartConfig) withDefaults() SlowStartConfig {
+	d := DefaultSlowStartConfig
+	if c.Window <= 0 {
+		c.Window = d.Window
+	}
+	if c.Aggression <= 0 {
+		c.Aggression = d.Aggression
+	}
+	if c.MinWeightPercent <= 0 {
+		c.MinWeightPercent = d.MinWeightPercent
+	}
+	return c
+}
+
+// InitSlowStartBuilders registers round_robin_x and random_x again with slow
+// start enabled. A slow_start entry in the service config of a ClientConn
+// overrides config.
+func InitSlowStartBuilders(config SlowStartConfig) {
+	config = config.withDefaults()
+	balancer.Register(newSlowStartPolicyBuilder(RoundRobin, &config, func(s *slowStart) base.PickerBuilder {
+		return &roundRobinPickerBuilder{slowStart: s}
+	}))
+	balancer.Register(newSlowStartPolicyBuilder(Random, &config, func(s *slowStart) base.PickerBuilder {
+		return &randomPickerBuilder{slowStart: s}
+	}))
+}
+
+// slowStartLBConfig is the service config of round_robin_x and random_x, e.g.
+// {"slow_start": {"window": "30s", "aggression": 1, "min_weight_percent": 10}}.
+type slowStartLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	SlowStart *struct {
+		Window           duration `json:"window"`
+		Aggression       float64  `json:"aggression"`
+		MinWeightPercent float64  `json:"min_weight_percent"`
+	} `json:"slow_start,omitempty"`
+}
+
+// newSlowStartPolicyBuilder creates the builder of a policy supporting slow
+// start, which is disabled if config is nil and the service config has none.
+// Every ClientConn gets its own picker builder, so that the time its SubConns
+// became ready is tracked per ClientConn.
+func newSlowStartPolicyBuilder(name string, config *SlowStartConfig, newPickerBuilder func(s *slowStart) base.PickerBuilder) balancer.Builder {
+	return &configBuilder{
+		name: name,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			return parseLBConfig(name, js, &slowStartLBConfig{})
+		},
+		newPickerBuilder: func(lbConfig serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			c := config
+			if lbc, ok := lbConfig.(*slowStartLBConfig); ok && lbc.SlowStart != nil {
+				c = &SlowStartConfig{
+					Window:           time.Duration(lbc.SlowStart.Window),
+					Aggression:       lbc.SlowStart.Aggression,
+					MinWeightPercent: lbc.SlowStart.MinWeightPercent,
+				}
+				*c = c.withDefaults()
+			}
+			if c == nil {
+				return newPickerBuilder(nil)
+			}
+			return newPickerBuilder(&slowStart{
+				config:     *c,
+				readySince: make(map[balancer.SubConn]time.Time),
+			})
+		},
+	}
+}
+
+// slowStart remembers since when the SubConns of one ClientConn are ready.
+// update is only called from PickerBuilder.Build, which base calls from the
+// balancer goroutine, so it needs no lock.
+type slowStart struct {
+	config     SlowStartConfig
+	readySince map[balancer.SubConn]time.Time
+}
+
+// update records the SubConns that became ready and forgets the others. A
+// SubConn that leaves the ready state starts slowly again when it comes back.
+// It returns the time the last SubConn finishes its slow start.
+func (s *slowStart) update(buildInfo base.PickerBuildInfo) time.Time {
+	now := time.Now()
+	for sc := range s.readySince {
+		if _, ok := buildInfo.ReadySCs[sc]; !ok {
+			delete(s.readySince, sc)
+		}
+	}
+	var warmUntil time.Time
+	for sc := range buildInfo.ReadySCs {
+		since, ok := s.readySince[sc]
+		if !ok {
+			since = now
+			s.readySince[sc] = since
+		}
+		if end := since.Add(s.config.Window); end.After(warmUntil) {
+			warmUntil = end
+		}
+	}
+	return warmUntil
+}
+
+// factor returns the fraction of its weight a SubConn ready since the given
+// time gets at now.
+func (s *slowStart) factor(since, now time.Time) float64 {
+	elapsed := now.Sub(since)
+	if elapsed >= s.config.Window {
+		return 1
+	}
+	f := math.Pow(float64(elapsed)/float64(s.config.Window), 1/s.config.Aggression)
+	return math.Max(f, s.config.MinWeightPercent/100)
+}
@@ -0,0 +1,98 @@
+package balancer
+
+import (
+	"context"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/metadata"
+)
+
+const Sticky = "sticky_x"
+
+// StickyName returns the name the sticky session wrapper of the child balancer
+// is registered under.
+func StickyName(child string) string {
+	return Sticky + "_" + child
+}
+
+// InitStickyBuilder registers a balancer named StickyName(child) that sends
+// the calls carrying an affinity token to the SubConn of the token's address
+// while it is ready, and the other calls to the child balancer. Unlike a
+// consistent hash, a session stays on its server when others come or go.
+//
+// The servers send the token with common.AffinityUnaryServerInterceptor or
+// common.AffinityStreamServerInterceptor, the caller reads it from the header
+// with AffinityToken and passes it on with WithAffinityToken.
+func InitStickyBuilder(child string) {
+	balancer.Register(&wrapperBuilder{
+		name:  StickyName(child),
+		child: child,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return &stickyWrapper{b: b}
+		},
+	})
+}
+
+// AffinityToken returns the affinity token from the header metadata of a
+// response, or an empty string if the server sent none.
+func AffinityToken(header metadata.MD) string {
+	values := header.Get(common.AffinityKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// WithAffinityToken returns a context whose calls carry the affinity token.
+func WithAffinityToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, common.AffinityKey, token)
+}
+
+type stickyWrapper struct {
+	b *wrapperBalancer
+}
+
+func (w *stickyWrapper) addSubConn(sc balancer.SubConn) {
+}
+
+func (w *stickyWrapper) removeSubConn(sc balancer.SubConn) {
+}
+
+func (w *stickyWrapper) updateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+}
+
+func (w *stickyWrapper) wrapPicker(picker balancer.Picker) balancer.Picker {
+	p := &stickyPicker{
+		picker: picker,
+		ready:  make(map[string]balancer.SubConn),
+	}
+	for _, sc := range w.b.ready() {
+		if addr, ok := w.b.addrs[sc]; ok {
+			p.ready[addr.Addr] = sc
+		}
+	}
+	return p
+}
+
+func (w *stickyWrapper) close() {
+}
+
+type stickyPicker struct {
+	picker balancer.Picker
+	ready  map[string]balancer.SubConn // by address
+}
+
+func (p *stickyPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	md, _ := metadata.FromOutgoingContext(info.Ctx)
+	if values := md.Get(common.AffinityKey); len(values) > 0 {
+		if sc, ok := p.ready[values[0]]; ok {
+			// through the child, which counts the call like its own picks
+			return pickSubConn(p.picker, info, sc), nil
+		}
+	}
+	return p.picker.Pick(info)
+}
+
+func (p *stickyPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	return trySubConn(p.picker, info, sc)
+}
@@ -0,0 +1,67 @@
+package balancer
+
+import (
+	"context"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"testing"
+)
+
+func TestStickyPicker(t *testing.T) {
+	cc, b := newTestWrapper(t, &wrapperBuilder{
+		name:  StickyName(LeastConnection),
+		child: LeastConnection,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return &stickyWrapper{b: b}
+		},
+	}, 3)
+	defer b.Close()
+	sc := cc.subConns[0]
+	ctx := WithAffinityToken(context.Background(), b.addrs[sc].Addr)
+
+	// the calls of the session go to its SubConn and count in the child
+	var session []balancer.PickResult
+	for i := 0; i < 5; i++ {
+		ret, err := cc.pick(ctx)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if ret.SubConn != sc {
+			t.Fatalf("pick %d with the token of %v went to %v", i, sc, ret.SubConn)
+		}
+		if ret.Done == nil {
+			t.Fatalf("pick %d with the token has no Done from the child", i)
+		}
+		session = append(session, ret)
+	}
+	if picked := cc.picked(t, 30); picked[sc] != 0 {
+		t.Fatalf("picks without a token while the session has 5 calls = %v", picked)
+	}
+	for _, ret := range session {
+		ret.Done(balancer.DoneInfo{})
+	}
+
+	// a token of an unknown address goes to the child
+	other := WithAffinityToken(context.Background(), "10.0.1.1:8080")
+	if _, err := cc.pick(other); err != nil {
+		t.Fatalf("pick with an unknown token: %v", err)
+	}
+
+	// the session moves to the child while its SubConn is not ready
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.TransientFailure})
+	for i := 0; i < 30; i++ {
+		ret, err := cc.pick(ctx)
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if ret.SubConn == sc {
+			t.Fatalf("pick %d with the token went to its SubConn in TransientFailure", i)
+		}
+		ret.Done(balancer.DoneInfo{})
+	}
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Connecting})
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	if ret, err := cc.pick(ctx); err != nil || ret.SubConn != sc {
+		t.Fatalf("pick with the token after its SubConn is ready again = %v, %v", ret.SubConn, err)
+	}
+}
@@ -0,0 +1,165 @@
+package balancer
+
+import (
+	"container/heap"
+	"encoding/json"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"os"
+)
+
+const Subset = "subset_x"
+
+// DefaultSubsetSize is the number of addresses a client connects to.
+const DefaultSubsetSize = 20
+
+// SubsetConfig configures the subsetting wrapper.
+type SubsetConfig struct {
+	// ClientID identifies the client, the same id always gets the same
+	// subset. It defaults to the host name.
+	ClientID string
+	// Size is the number of addresses passed on to the child balancer.
+	Size int
+}
+
+// SubsetName returns the name the subsetting wrapper of the child balancer is
+// registered under.
+func SubsetName(child string) string {
+	return Subset + "_" + child
+}
+
+// InitSubsetBuilder registers a balancer named SubsetName(child) that passes
+// only a subset of the resolved addresses to the child balancer. The subset
+// holds the config.Size addresses with the highest rendezvous hash score for
+// the client id, so it is stable, and a membership change only replaces the
+// addresses that joined or left the subset.
+func InitSubsetBuilder(child string, config SubsetConfig) {
+	balancer.Register(newSubsetBuilder(child, config))
+}
+
+// newSubsetBuilder creates a new subsetting balancer builder.
+func newSubsetBuilder(child string, config SubsetConfig) balancer.Builder {
+	if config.ClientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			grpclog.Errorf("subset: get host name error: %v", err)
+		}
+		config.ClientID = hostname
+	}
+	if config.Size <= 0 {
+		config.Size = DefaultSubsetSize
+	}
+	return &subsetBuilder{
+		name:   SubsetName(child),
+		child:  child,
+		config: config,
+	}
+}
+
+type subsetBuilder struct {
+	name   string
+	child  string
+	config SubsetConfig
+}
+
+func (bb *subsetBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	childBuilder := balancer.Get(bb.child)
+	if childBuilder == nil {
+		grpclog.Errorf("%s: child balancer %q is not registered, using %q", bb.name, bb.child, RoundRobin)
+		childBuilder = balancer.Get(RoundRobin)
+	}
+	return &subsetBalancer{
+		Balancer: childBuilder.Build(cc, opts),
+		config:   bb.config,
+	}
+}
+
+func (bb *subsetBuilder) Name() string {
+	return bb.name
+}
+
+func (bb *subsetBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseChildConfig(bb.child, js)
+}
+
+type subsetBalancer struct {
+	balancer.Balancer
+	config SubsetConfig
+}
+
+func (b *subsetBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	all := len(s.ResolverState.Addresses)
+	s.ResolverState.Addresses = subsetAddresses(s.ResolverState.Addresses, b.config.ClientID, b.config.Size)
+	grpclog.Infof("subset: %d of %d addresses selected for client %q", len(s.ResolverState.Addresses), all, b.config.ClientID)
+	return b.Balancer.UpdateClientConnState(s)
+}
+
+// subsetAddresses returns the size addresses with the highest weighted
+// rendezvous score for clientID, in the order of addrs. Every address is
+// scored once and a heap keeps the best size of them, so an update costs
+// O(n log size).
+func subsetAddresses(addrs []resolver.Address, clientID string, size int) []resolver.Address {
+	if len(addrs) <= size {
+		return addrs
+	}
+	h := make(subsetHeap, 0, size)
+	for i, addr := range addrs {
+		weight := common.GetWeight(addr)
+		if weight <= 0 {
+			continue
+		}
+		c := subsetCandidate{
+			index: i,
+			name:  addr.Addr,
+			score: rendezvousNode{addr.Addr, float64(weight)}.score(clientID),
+		}
+		if len(h) < size {
+			heap.Push(&h, c)
+		} else if h[0].worse(c) {
+			h[0] = c
+			heap.Fix(&h, 0)
+		}
+	}
+	selected := make([]bool, len(addrs))
+	for _, c := range h {
+		selected[c.index] = true
+	}
+	ret := make([]resolver.Address, 0, len(h))
+	for i, addr := range addrs {
+		if selected[i] {
+			ret = append(ret, addr)
+		}
+	}
+	return ret
+}
+
+type subsetCandidate struct {
+	index int // in the resolved addresses
+	name  string
+	score float64
+}
+
+// worse orders candidates like Rendezvous.GetN: by score, then by name.
+func (c subsetCandidate) worse(o subsetCandidate) bool {
+	if c.score == o.score {
+		return c.name > o.name
+	}
+	return c.score < o.score
+}
+
+// subsetHeap is a min-heap with the worst selected candidate on top.
+type subsetHeap []subsetCandidate
+
+func (h subsetHeap) Len() int            { return len(h) }
+func (h subsetHeap) Less(i, j int) bool  { return h[i].worse(h[j]) }
+func (h subsetHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *subsetHeap) Push(x interface{}) { *h = append(*h, x.(subsetCandidate)) }
+func (h *subsetHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
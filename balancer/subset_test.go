@@ -0,0 +1,97 @@
+package balancer
+
+import (
+	"fmt"
+	"google.golang.org/grpc/resolver"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testAddresses(n int) []resolver.Address {
+	var addrs []resolver.Address
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.%d.%d:8080", i/256, i%256)})
+	}
+	return addrs
+}
+
+func subsetNames(addrs []resolver.Address) []string {
+	var names []string
+	for _, addr := range addrs {
+		names = append(names, addr.Addr)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// subsetChanges returns how many members of a are not in b.
+func subsetChanges(a, b []resolver.Address) int {
+	in := make(map[string]bool)
+	for _, addr := range b {
+		in[addr.Addr] = true
+	}
+	changes := 0
+	for _, addr := range a {
+		if !in[addr.Addr] {
+			changes++
+		}
+	}
+	return changes
+}
+
+func TestSubsetAddresses(t *testing.T) {
+	const size = 20
+	addrs := testAddresses(300)
+	subset := subsetAddresses(addrs, "client", size)
+	if len(subset) != size {
+		t.Fatalf("subset of %d addresses, want %d", len(subset), size)
+	}
+
+	// the subset is the top of the rendezvous ranking
+	hash := NewRendezvous()
+	for _, addr := range addrs {
+		hash.Add(addr.Addr, 1)
+	}
+	want := hash.GetN("client", size)
+	sort.Strings(want)
+	if got := subsetNames(subset); !reflect.DeepEqual(got, want) {
+		t.Fatalf("subset %v, want %v", got, want)
+	}
+
+	if other := subsetAddresses(addrs, "other-client", size); reflect.DeepEqual(subsetNames(other), want) {
+		t.Fatal("two clients got the same subset")
+	}
+}
+
+func TestSubsetAddressesChurn(t *testing.T) {
+	const size = 20
+	r := rand.New(rand.NewSource(1))
+	pool := testAddresses(400)
+	present := make(map[int]bool)
+	for i := 0; i < 300; i++ {
+		present[i] = true
+	}
+	resolve := func() []resolver.Address {
+		var addrs []resolver.Address
+		for _, i := range r.Perm(len(pool)) {
+			if present[i] {
+				addrs = append(addrs, pool[i])
+			}
+		}
+		return addrs
+	}
+
+	subset := subsetAddresses(resolve(), "client", size)
+	for i := 0; i < 500; i++ {
+		// one address joins or leaves
+		j := r.Intn(len(pool))
+		present[j] = !present[j]
+		next := subsetAddresses(resolve(), "client", size)
+		if changes := subsetChanges(subset, next); changes > 1 {
+			t.Fatalf("change %d: %s joining or leaving replaced %d members of the subset", i, pool[j].Addr, changes)
+		}
+		subset = next
+	}
+}
@@ -0,0 +1,164 @@
+package balancer
+
+import (
+	"encoding/json"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+	"sort"
+)
+
+const VersionSplit = "version_split_x"
+
+// DefaultVersionHeader is the outgoing metadata header forcing a request to a
+// version.
+const DefaultVersionHeader = "x-grpclb-version"
+
+// VersionSplitConfig configures the version_split_x balancer, used with a
+// resolver registered by RegisterMultiVersionResolver.
+type VersionSplitConfig struct {
+	// Percents maps a version to its share of the traffic. The shares of the
+	// versions without ready instances are split over the others. Versions
+	// not listed get no traffic unless no listed version is ready.
+	Percents map[string]int
+	// Header is the outgoing metadata header whose value forces the request
+	// to a version, e.g. for test traffic. It defaults to
+	// DefaultVersionHeader.
+	Header string
+}
+
+func InitVersionSplitBuilder(config VersionSplitConfig) {
+	balancer.Register(newVersionSplitBuilder(config))
+}
+
+// versionSplitLBConfig is the service config of version_split_x, e.g.
+// {"percents": {"v1": 90, "v2": 10}, "header": "x-version"}.
+type versionSplitLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Percents map[string]int `json:"percents,omitempty"`
+	Header   string         `json:"header,omitempty"`
+}
+
+// newVersionSplitBuilder creates a new version split balancer builder.
+func newVersionSplitBuilder(config VersionSplitConfig) balancer.Builder {
+	if config.Header == "" {
+		config.Header = DefaultVersionHeader
+	}
+	return &configBuilder{
+		name: VersionSplit,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			return parseLBConfig(VersionSplit, js, &versionSplitLBConfig{})
+		},
+		newPickerBuilder: func(lbConfig serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			c := config
+			if lbc, ok := lbConfig.(*versionSplitLBConfig); ok {
+				if lbc.Percents != nil {
+					c.Percents = lbc.Percents
+				}
+				if lbc.Header != "" {
+					c.Header = lbc.Header
+				}
+			}
+			return &versionSplitPickerBuilder{c}
+		},
+	}
+}
+
+type versionSplitPickerBuilder struct {
+	config VersionSplitConfig
+}
+
+func (b *versionSplitPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("versionSplitPicker: newPicker called with buildInfo: %v", buildInfo)
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	groups := make(map[string]base.PickerBuildInfo)
+	for sc, info := range buildInfo.ReadySCs {
+		version := common.GetVersion(info.Address)
+		group, ok := groups[version]
+		if !ok {
+			group = base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+			groups[version] = group
+		}
+		group.ReadySCs[sc] = info
+	}
+
+	picker := &versionSplitPicker{
+		header:   b.config.Header,
+		versions: make(map[string]balancer.Picker),
+		all:      (&roundRobinPickerBuilder{}).Build(buildInfo),
+	}
+	for version, group := range groups {
+		picker.versions[version] = (&roundRobinPickerBuilder{}).Build(group)
+	}
+
+	var versions []string
+	for version := range b.config.Percents {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	for _, version := range versions {
+		percent := b.config.Percents[version]
+		if _, ok := groups[version]; !ok || percent <= 0 {
+			continue
+		}
+		picker.total += percent
+		picker.split = append(picker.split, versionShare{version, percent})
+	}
+	return picker
+}
+
+type versionShare struct {
+	version string
+	percent int
+}
+
+type versionSplitPicker struct {
+	header   string
+	versions map[string]balancer.Picker
+	split    []versionShare
+	total    int
+	// all is used when none of the configured versions is ready
+	all balancer.Picker
+}
+
+func (p *versionSplitPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	if md, ok := metadata.FromOutgoingContext(info.Ctx); ok {
+		if values := md.Get(p.header); len(values) > 0 {
+			picker, ok := p.versions[values[0]]
+			if !ok {
+				return balancer.PickResult{}, status.Errorf(codes.Unavailable, "grpclb: no ready instance of version %q", values[0])
+			}
+			return picker.Pick(info)
+		}
+	}
+
+	if p.total == 0 {
+		return p.all.Pick(info)
+	}
+	r := randIntn(p.total)
+	for _, share := range p.split {
+		if r < share.percent {
+			return p.versions[share.version].Pick(info)
+		}
+		r -= share.percent
+	}
+	return p.all.Pick(info)
+}
+
+func (p *versionSplitPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	for _, picker := range p.versions {
+		if ret, ok := trySubConn(picker, info, sc); ok {
+			return ret, true
+		}
+	}
+	return trySubConn(p.all, info, sc)
+}
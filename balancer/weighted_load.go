@@ -0,0 +1,284 @@
+package balancer
+
+import (
+	"encoding/json"
+	"github.com/liyue201/grpc-lb/common"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/serviceconfig"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const WeightedLoad = "weighted_load_x"
+
+// WeightedLoadConfig configures the weighted_load_x balancer, which weights
+// the backends by the load reports of common.LoadReporter.
+type WeightedLoadConfig struct {
+	// BlackoutPeriod is how long a backend must report its load before the
+	// reports are used, so that a backend that just started is not flooded.
+	BlackoutPeriod time.Duration
+	// ExpirationPeriod is how long a report is used. A backend whose last
+	// report is older starts over with the blackout period.
+	ExpirationPeriod time.Duration
+}
+
+var DefaultWeightedLoadConfig = WeightedLoadConfig{
+	BlackoutPeriod:   10 * time.Second,
+	ExpirationPeriod: 3 * time.Minute,
+}
+
+func (c WeightedLoadConfig) withDefaults() WeightedLoadConfig {
+	if c.BlackoutPeriod <= 0 {
+		c.BlackoutPeriod = DefaultWeightedLoadConfig.BlackoutPeriod
+	}
+	if c.ExpirationPeriod <= 0 {
+		c.ExpirationPeriod = DefaultWeightedLoadConfig.ExpirationPeriod
+	}
+	return c
+}
+
+// InitWeightedLoadBuilder registers weighted_load_x again with config.
+func InitWeightedLoadBuilder(config WeightedLoadConfig) {
+	balancer.Register(newWeightedLoadBuilder(config))
+}
+
+// weightedLoadLBConfig is the service config of weighted_load_x, e.g.
+// {"blackout_period": "10s", "expiration_period": "3m"}.
+type weightedLoadLBConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	BlackoutPeriod   duration `json:"blackout_period,omitempty"`
+	ExpirationPeriod duration `json:"expiration_period,omitempty"`
+}
+
+// newWeightedLoadBuilder creates a new weighted load balancer builder. Every
+// ClientConn gets its own picker builder, which keeps the weights of its
+// SubConns across pickers.
+func newWeightedLoadBuilder(config WeightedLoadConfig) balancer.Builder {
+	config = config.withDefaults()
+	return &configBuilder{
+		name: WeightedLoad,
+		parseConfig: func(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+			return parseLBConfig(WeightedLoad, js, &weightedLoadLBConfig{})
+		},
+		newPickerBuilder: func(lbConfig serviceconfig.LoadBalancingConfig) base.PickerBuilder {
+			c := config
+			if lbc, ok := lbConfig.(*weightedLoadLBConfig); ok {
+				if lbc.BlackoutPeriod > 0 {
+					c.BlackoutPeriod = time.Duration(lbc.BlackoutPeriod)
+				}
+				if lbc.ExpirationPeriod > 0 {
+					c.ExpirationPeriod = time.Duration(lbc.ExpirationPeriod)
+				}
+			}
+			return &weightedLoadPickerBuilder{
+				config: c,
+				nodes:  make(map[balancer.SubConn]*loadNode),
+			}
+		},
+	}
+}
+
+func init() {
+	balancer.Register(newWeightedLoadBuilder(DefaultWeightedLoadConfig))
+}
+
+type weightedLoadPickerBuilder struct {
+	config WeightedLoadConfig
+	nodes  map[balancer.SubConn]*loadNode
+}
+
+func (b *weightedLoadPickerBuilder) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	grpclog.Infof("weightedLoadPicker: newPicker called with buildInfo: %v", buildInfo)
+
+	for sc := range b.nodes {
+		if _, ok := buildInfo.ReadySCs[sc]; !ok {
+			delete(b.nodes, sc)
+		}
+	}
+	if len(buildInfo.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	picker := &weightedLoadPicker{config: b.config}
+	for sc, info := range buildInfo.ReadySCs {
+		node, ok := b.nodes[sc]
+		if !ok {
+			node = &loadNode{subConn: sc}
+			b.nodes[sc] = node
+		}
+		weight := common.GetWeight(info.Address)
+		if weight <= 0 {
+			continue
+		}
+		picker.nodes = append(picker.nodes, node)
+		picker.static = append(picker.static, float64(weight))
+	}
+	if len(picker.nodes) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+	picker.weights.Store(picker.newWeights(time.Now()))
+	return picker
+}
+
+// loadNode is a SubConn weighted by its load reports.
+type loadNode struct {
+	subConn balancer.SubConn
+
+	mu            sync.Mutex
+	weight        float64
+	nonEmptySince time.Time // first report since the weight was last expired
+	lastUpdated   time.Time
+}
+
+// report updates the weight from a load report. The weight is the number of
+// requests per second per unit of CPU, divided by the queue depth.
+func (n *loadNode) report(r common.LoadReport, now time.Time) {
+	if r.CPUUtilization <= 0 || r.QPS <= 0 {
+		return
+	}
+	weight := r.QPS / r.CPUUtilization / float64(1+r.InFlight)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nonEmptySince.IsZero() {
+		n.nonEmptySince = now
+	}
+	n.lastUpdated = now
+	n.weight = weight
+}
+
+// loadWeight returns the weight from the load reports, or 0 if there is no
+// usable report.
+func (n *loadNode) loadWeight(config *WeightedLoadConfig, now time.Time) float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.nonEmptySince.IsZero() {
+		return 0
+	}
+	if now.Sub(n.lastUpdated) >= config.ExpirationPeriod {
+		n.nonEmptySince = time.Time{}
+		return 0
+	}
+	if now.Sub(n.nonEmptySince) < config.BlackoutPeriod {
+		return 0
+	}
+	return n.weight
+}
+
+// weightedLoadPicker spreads the picks over the load weights with a golden
+// ratio sequence, which is deterministic and as even as a round robin, and
+// needs no lock: a pick only advances an atomic counter and reads an immutable
+// weights snapshot. Backends without usable reports get the mean load weight,
+// or all backends use common.GetWeight if none has one.
+type weightedLoadPicker struct {
+	config WeightedLoadConfig
+	nodes  []*loadNode
+	static []float64 // common.GetWeight of the nodes
+
+	weights  atomic.Value // *loadWeights
+	updating int32
+	index    uint64
+}
+
+type loadWeights struct {
+	cumulative []float64 // running sums of the weights
+	updated    time.Time
+}
+
+// weightsInterval is how often the picker computes the weights again.
+const weightsInterval = time.Second
+
+// goldenRatio64 is 2^64 divided by the golden ratio.
+const goldenRatio64 = 0x9e3779b97f4a7c15
+
+func (p *weightedLoadPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	now := time.Now()
+
+	w := p.loadWeights(now)
+	total := w.cumulative[len(w.cumulative)-1]
+	x := atomic.AddUint64(&p.index, goldenRatio64)
+	r := float64(x>>11) / (1 << 53) * total
+	i := sort.Search(len(w.cumulative), func(i int) bool {
+		return w.cumulative[i] > r
+	})
+	if i == len(w.cumulative) {
+		i--
+	}
+	return p.track(p.nodes[i]), nil
+}
+
+func (p *weightedLoadPicker) pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	for _, node := range p.nodes {
+		if node.subConn == sc {
+			return p.track(node), true
+		}
+	}
+	return balancer.PickResult{}, false
+}
+
+// track returns node with a Done that reads the load report of the response.
+func (p *weightedLoadPicker) track(node *loadNode) balancer.PickResult {
+	ret := balancer.PickResult{SubConn: node.subConn}
+	ret.Done = func(info balancer.DoneInfo) {
+		values := info.Trailer.Get(common.LoadReportKey)
+		if len(values) == 0 {
+			return
+		}
+		r, err := common.ParseLoadReport(values[0])
+		if err != nil {
+			grpclog.Warningf("weightedLoadPicker: %v", err)
+			return
+		}
+		node.report(r, time.Now())
+	}
+	return ret
+}
+
+// loadWeights returns the current weights, one pick computes them again when
+// they are older than weightsInterval while the others keep the old ones.
+func (p *weightedLoadPicker) loadWeights(now time.Time) *loadWeights {
+	w := p.weights.Load().(*loadWeights)
+	if now.Sub(w.updated) < weightsInterval || !atomic.CompareAndSwapInt32(&p.updating, 0, 1) {
+		return w
+	}
+	w = p.newWeights(now)
+	p.weights.Store(w)
+	atomic.StoreInt32(&p.updating, 0)
+	return w
+}
+
+func (p *weightedLoadPicker) newWeights(now time.Time) *loadWeights {
+	weights := make([]float64, len(p.nodes))
+	sum := 0.0
+	n := 0
+	for i, node := range p.nodes {
+		weights[i] = node.loadWeight(&p.config, now)
+		if weights[i] > 0 {
+			sum += weights[i]
+			n++
+		}
+	}
+	w := &loadWeights{
+		cumulative: make([]float64, len(p.nodes)),
+		updated:    now,
+	}
+	total := 0.0
+	for i := range p.nodes {
+		switch {
+		case n == 0:
+			weights[i] = p.static[i]
+		case weights[i] == 0:
+			weights[i] = sum / float64(n)
+		}
+		total += weights[i]
+		w.cumulative[i] = total
+	}
+	return w
+}
@@ -0,0 +1,256 @@
+package balancer
+
+import (
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"sync"
+)
+
+var errSubConnHidden = errors.New("grpclb: SubConn is hidden by a balancer wrapper")
+
+// isDroppedPick reports whether err is passed to the Done of a pick that a
+// wrapper rejected before any RPC used it. Done must still release what the
+// pick acquired, but not count it as a result of the SubConn.
+func isDroppedPick(err error) bool {
+	return err == errPickExcluded || err == errPickLimited
+}
+
+// subConnPicker is implemented by the pickers that keep state in Done, so
+// that a wrapper choosing a SubConn on its own still goes through them.
+type subConnPicker interface {
+	// pickSubConn picks sc as if Pick had chosen it, or returns false if sc
+	// is not one of the picker's SubConns.
+	pickSubConn(info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool)
+}
+
+// trySubConn picks sc through picker, if the picker supports it.
+func trySubConn(picker balancer.Picker, info balancer.PickInfo, sc balancer.SubConn) (balancer.PickResult, bool) {
+	if p, ok := picker.(subConnPicker); ok {
+		return p.pickSubConn(info, sc)
+	}
+	return balancer.PickResult{}, false
+}
+
+// pickSubConn picks sc through picker, or without a Done if the picker keeps
+// no state for it.
+func pickSubConn(picker balancer.Picker, info balancer.PickInfo, sc balancer.SubConn) balancer.PickResult {
+	if ret, ok := trySubConn(picker, info, sc); ok {
+		return ret
+	}
+	return balancer.PickResult{SubConn: sc}
+}
+
+// balancerWrapper adds behaviour on top of a child balancer, like ejecting
+// unhealthy SubConns, without the child having to know about it.
+type balancerWrapper interface {
+	// addSubConn is called when the child creates a SubConn.
+	addSubConn(sc balancer.SubConn)
+	// removeSubConn is called when the child removes a SubConn.
+	removeSubConn(sc balancer.SubConn)
+	// updateSubConnState is called with every state change reported by gRPC,
+	// including those hidden from the child.
+	updateSubConnState(sc balancer.SubConn, state balancer.SubConnState)
+	// wrapPicker wraps every picker produced by the child.
+	wrapPicker(picker balancer.Picker) balancer.Picker
+	close()
+}
+
+// wrapperBuilder builds a wrapperBalancer around the balancer registered as
+// child. The child is looked up when a ClientConn is built, so it may be
+// registered after the wrapper.
+type wrapperBuilder struct {
+	name       string
+	child      string
+	newWrapper func(b *wrapperBalancer) balancerWrapper
+}
+
+func (bb *wrapperBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	childBuilder := balancer.Get(bb.child)
+	if childBuilder == nil {
+		grpclog.Errorf("%s: child balancer %q is not registered, using %q", bb.name, bb.child, RoundRobin)
+		childBuilder = balancer.Get(RoundRobin)
+	}
+	b := &wrapperBalancer{
+		cc:     cc,
+		states: make(map[balancer.SubConn]balancer.SubConnState),
+		hidden: make(map[balancer.SubConn]bool),
+		addrs:  make(map[balancer.SubConn]resolver.Address),
+	}
+	b.wrapper = bb.newWrapper(b)
+	b.child = childBuilder.Build(&wrapperClientConn{ClientConn: cc, b: b}, opts)
+	return b
+}
+
+func (bb *wrapperBuilder) Name() string {
+	return bb.name
+}
+
+// ParseConfig parses the service config of the child balancer, which gets it
+// in UpdateClientConnState.
+func (bb *wrapperBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	return parseChildConfig(bb.child, js)
+}
+
+// parseChildConfig parses js with the balancer registered as child, if it
+// has a config.
+func parseChildConfig(child string, js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	parser, ok := balancer.Get(child).(balancer.ConfigParser)
+	if !ok {
+		return nil, nil
+	}
+	return parser.ParseConfig(js)
+}
+
+// wrapperBalancer forwards everything to the child balancer, except that
+// SubConns hidden by the wrapper are reported to the child as
+// TransientFailure, so that the child builds its pickers without them.
+type wrapperBalancer struct {
+	cc      balancer.ClientConn
+	child   balancer.Balancer
+	wrapper balancerWrapper
+
+	// mu serializes the calls into the child, which may also come from
+	// hide and show outside of the gRPC balancer goroutine. It is held while
+	// the child calls back into wrapperClientConn.
+	mu     sync.Mutex
+	closed bool
+	states map[balancer.SubConn]balancer.SubConnState
+	hidden map[balancer.SubConn]bool
+	addrs  map[balancer.SubConn]resolver.Address
+	// state is the last state reported by the child, with its own picker
+	state *balancer.State
+}
+
+func (b *wrapperBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.child.UpdateClientConnState(s)
+}
+
+func (b *wrapperBalancer) ResolverError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.child.ResolverError(err)
+}
+
+func (b *wrapperBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.states[sc] = state
+	hidden := b.hidden[sc]
+	if state.ConnectivityState == connectivity.Shutdown {
+		delete(b.states, sc)
+		delete(b.hidden, sc)
+		delete(b.addrs, sc)
+		hidden = false
+	}
+	b.wrapper.updateSubConnState(sc, state)
+
+	if !hidden {
+		b.child.UpdateSubConnState(sc, state)
+	}
+}
+
+func (b *wrapperBalancer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.wrapper.close()
+	b.child.Close()
+}
+
+// hide makes the child see sc as TransientFailure until show is called.
+func (b *wrapperBalancer) hide(sc balancer.SubConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.states[sc]
+	if !ok || b.hidden[sc] || b.closed {
+		return
+	}
+	b.hidden[sc] = true
+
+	b.child.UpdateSubConnState(sc, balancer.SubConnState{
+		ConnectivityState: connectivity.TransientFailure,
+		ConnectionError:   errSubConnHidden,
+	})
+}
+
+// show reports the real state of a hidden sc to the child again.
+func (b *wrapperBalancer) show(sc balancer.SubConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.states[sc]
+	if !ok || !b.hidden[sc] || b.closed {
+		return
+	}
+	delete(b.hidden, sc)
+
+	b.child.UpdateSubConnState(sc, state)
+}
+
+// ready returns the SubConns that are ready and not hidden. It must be called
+// with mu held, as in the wrapper methods.
+func (b *wrapperBalancer) ready() []balancer.SubConn {
+	var ready []balancer.SubConn
+	for sc, state := range b.states {
+		if state.ConnectivityState == connectivity.Ready && !b.hidden[sc] {
+			ready = append(ready, sc)
+		}
+	}
+	return ready
+}
+
+// updatePicker wraps the last picker of the child again and sends it to gRPC,
+// which makes the picks blocked by balancer.ErrNoSubConnAvailable try again.
+func (b *wrapperBalancer) updatePicker() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == nil || b.closed {
+		return
+	}
+	(&wrapperClientConn{ClientConn: b.cc, b: b}).UpdateState(*b.state)
+}
+
+// wrapperClientConn intercepts the calls of the child balancer to the
+// ClientConn.
+type wrapperClientConn struct {
+	balancer.ClientConn
+	b *wrapperBalancer
+}
+
+func (cc *wrapperClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc, err := cc.ClientConn.NewSubConn(addrs, opts)
+	if err != nil {
+		return nil, err
+	}
+	cc.b.states[sc] = balancer.SubConnState{ConnectivityState: connectivity.Idle}
+	if len(addrs) > 0 {
+		cc.b.addrs[sc] = addrs[0]
+	}
+	cc.b.wrapper.addSubConn(sc)
+	return sc, nil
+}
+
+func (cc *wrapperClientConn) RemoveSubConn(sc balancer.SubConn) {
+	cc.b.wrapper.removeSubConn(sc)
+	cc.ClientConn.RemoveSubConn(sc)
+}
+
+func (cc *wrapperClientConn) UpdateState(s balancer.State) {
+	last := s
+	cc.b.state = &last
+	s.Picker = newExcludePicker(cc.b.wrapper.wrapPicker(s.Picker), cc.b.ready())
+	cc.ClientConn.UpdateState(s)
+}
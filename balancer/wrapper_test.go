@@ -0,0 +1,203 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"sync"
+	"testing"
+)
+
+type testSubConn struct {
+	id int
+}
+
+func (sc *testSubConn) UpdateAddresses([]resolver.Address) {}
+
+func (sc *testSubConn) Connect() {}
+
+func (sc *testSubConn) String() string {
+	return fmt.Sprintf("SubConn(%d)", sc.id)
+}
+
+// testClientConn creates testSubConns and keeps the last picker.
+type testClientConn struct {
+	mu       sync.Mutex
+	subConns []balancer.SubConn
+	state    connectivity.State
+	picker   balancer.Picker
+}
+
+func (cc *testClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	sc := &testSubConn{id: len(cc.subConns)}
+	cc.subConns = append(cc.subConns, sc)
+	return sc, nil
+}
+
+func (cc *testClientConn) RemoveSubConn(balancer.SubConn) {}
+
+func (cc *testClientConn) UpdateState(s balancer.State) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.state = s.ConnectivityState
+	cc.picker = s.Picker
+}
+
+func (cc *testClientConn) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (cc *testClientConn) Target() string {
+	return "test"
+}
+
+// pick picks with the last picker like gRPC does for a call with ctx.
+func (cc *testClientConn) pick(ctx context.Context) (balancer.PickResult, error) {
+	cc.mu.Lock()
+	picker := cc.picker
+	cc.mu.Unlock()
+	return picker.Pick(balancer.PickInfo{FullMethodName: "/test.Service/Method", Ctx: ctx})
+}
+
+// picked returns how often each SubConn is picked in n successful calls.
+func (cc *testClientConn) picked(t *testing.T, n int) map[balancer.SubConn]int {
+	picked := make(map[balancer.SubConn]int)
+	for i := 0; i < n; i++ {
+		ret, err := cc.pick(context.Background())
+		if err != nil {
+			t.Fatalf("pick: %v", err)
+		}
+		if ret.Done != nil {
+			ret.Done(balancer.DoneInfo{})
+		}
+		picked[ret.SubConn]++
+	}
+	return picked
+}
+
+// testResolverAddresses returns n resolved addresses.
+func testResolverAddresses(n int) []resolver.Address {
+	var addrs []resolver.Address
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, resolver.Address{Addr: fmt.Sprintf("10.0.0.%d:8080", i)})
+	}
+	return addrs
+}
+
+// newTestBalancer builds bb on a testClientConn with n ready SubConns and the
+// service config js, if not empty.
+func newTestBalancer(t *testing.T, bb balancer.Builder, js string, n int) (*testClientConn, balancer.Balancer) {
+	cc := &testClientConn{}
+	b := bb.Build(cc, balancer.BuildOptions{})
+	state := balancer.ClientConnState{ResolverState: resolver.State{Addresses: testResolverAddresses(n)}}
+	if js != "" {
+		config, err := bb.(balancer.ConfigParser).ParseConfig(json.RawMessage(js))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state.BalancerConfig = config
+	}
+	if err := b.UpdateClientConnState(state); err != nil {
+		t.Fatal(err)
+	}
+	if len(cc.subConns) != n {
+		t.Fatalf("%d SubConns created, want %d", len(cc.subConns), n)
+	}
+	for _, sc := range cc.subConns {
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Connecting})
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+	return cc, b
+}
+
+// newTestWrapper builds bb on a testClientConn with n ready SubConns.
+func newTestWrapper(t *testing.T, bb balancer.Builder, n int) (*testClientConn, *wrapperBalancer) {
+	cc, b := newTestBalancer(t, bb, "", n)
+	return cc, b.(*wrapperBalancer)
+}
+
+// recordingBalancer records the SubConn states its parent forwards.
+type recordingBalancer struct {
+	balancer.Balancer
+	states map[balancer.SubConn]connectivity.State
+}
+
+func (b *recordingBalancer) UpdateSubConnState(sc balancer.SubConn, state balancer.SubConnState) {
+	b.states[sc] = state.ConnectivityState
+	b.Balancer.UpdateSubConnState(sc, state)
+}
+
+// testRecording is a round robin balancer that records its SubConn states in
+// recorded.
+const testRecording = "test_recording_x"
+
+var recorded *recordingBalancer
+
+type recordingBuilder struct{}
+
+func (recordingBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	recorded = &recordingBalancer{
+		Balancer: newRoundRobinBuilder().Build(cc, opts),
+		states:   make(map[balancer.SubConn]connectivity.State),
+	}
+	return recorded
+}
+
+func (recordingBuilder) Name() string {
+	return testRecording
+}
+
+func init() {
+	balancer.Register(recordingBuilder{})
+}
+
+func TestWrapperHideShow(t *testing.T) {
+	cc, b := newTestWrapper(t, &wrapperBuilder{
+		name:  "test_wrapper_x",
+		child: testRecording,
+		newWrapper: func(b *wrapperBalancer) balancerWrapper {
+			return attemptWrapper{}
+		},
+	}, 3)
+	defer b.Close()
+	sc := cc.subConns[0]
+
+	b.hide(sc)
+	if got := recorded.states[sc]; got != connectivity.TransientFailure {
+		t.Fatalf("hidden SubConn is %v in the child, want TransientFailure", got)
+	}
+	if picked := cc.picked(t, 30); picked[sc] != 0 || len(picked) != 2 {
+		t.Fatalf("picks with a hidden SubConn = %v", picked)
+	}
+
+	// the real state changes of a hidden SubConn wait for show
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Idle})
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	if got := recorded.states[sc]; got != connectivity.TransientFailure {
+		t.Fatalf("hidden SubConn is %v in the child after a state change, want TransientFailure", got)
+	}
+
+	b.show(sc)
+	if got := recorded.states[sc]; got != connectivity.Ready {
+		t.Fatalf("shown SubConn is %v in the child, want Ready", got)
+	}
+	if picked := cc.picked(t, 30); picked[sc] != 10 {
+		t.Fatalf("picks after show = %v", picked)
+	}
+
+	// a hidden SubConn that shuts down is forwarded and forgotten
+	b.hide(sc)
+	b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Shutdown})
+	if got := recorded.states[sc]; got != connectivity.Shutdown {
+		t.Fatalf("hidden SubConn is %v in the child after shutdown, want Shutdown", got)
+	}
+	b.show(sc)
+	if got := recorded.states[sc]; got != connectivity.Shutdown {
+		t.Fatalf("show changed a SubConn that shut down to %v", got)
+	}
+}
@@ -0,0 +1,31 @@
+package common
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// AffinityKey is the header metadata key of the session affinity token, the
+// address a server is registered under. Clients send the token back in their
+// outgoing metadata to stay on that server.
+const AffinityKey = "x-grpclb-affinity"
+
+// AffinityUnaryServerInterceptor returns an interceptor that sends addr,
+// the address the server is registered under, as the affinity token in the
+// response header.
+func AffinityUnaryServerInterceptor(addr string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		grpc.SetHeader(ctx, metadata.Pairs(AffinityKey, addr))
+		return handler(ctx, req)
+	}
+}
+
+// AffinityStreamServerInterceptor is the streaming version of
+// AffinityUnaryServerInterceptor.
+func AffinityStreamServerInterceptor(addr string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ss.SetHeader(metadata.Pairs(AffinityKey, addr))
+		return handler(srv, ss)
+	}
+}
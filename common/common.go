@@ -7,7 +7,10 @@ import (
 )
 
 const (
-	WeightKey = "weight"
+	WeightKey   = "weight"
+	LocalityKey = "locality"
+	VersionKey  = "version"
+	PriorityKey = "priority"
 )
 
 func GetWeight(addr resolver.Address) int {
@@ -26,3 +29,54 @@ func GetWeight(addr resolver.Address) int {
 	}
 	return 1
 }
+
+// GetLocality returns the locality (zone) of the instance behind addr, or an
+// empty string if it has none.
+func GetLocality(addr resolver.Address) string {
+	if addr.Metadata == nil {
+		return ""
+	}
+	md, ok := addr.Metadata.(*metadata.MD)
+	if ok {
+		values := md.Get(LocalityKey)
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// GetVersion returns the service version of the instance behind addr, or an
+// empty string if it has none.
+func GetVersion(addr resolver.Address) string {
+	if addr.Metadata == nil {
+		return ""
+	}
+	md, ok := addr.Metadata.(*metadata.MD)
+	if ok {
+		values := md.Get(VersionKey)
+		if len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// GetPriority returns the priority of the instance behind addr, 0 being the
+// highest. Instances without a valid priority have priority 0.
+func GetPriority(addr resolver.Address) int {
+	if addr.Metadata == nil {
+		return 0
+	}
+	md, ok := addr.Metadata.(*metadata.MD)
+	if ok {
+		values := md.Get(PriorityKey)
+		if len(values) > 0 {
+			priority, err := strconv.Atoi(values[0])
+			if err == nil && priority >= 0 {
+				return priority
+			}
+		}
+	}
+	return 0
+}
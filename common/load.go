@@ -0,0 +1,129 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadReportKey is the trailing metadata key servers send their load reports
+// under.
+const LoadReportKey = "x-grpclb-load"
+
+// LoadReport is the load of a server, sent to the clients with every response.
+type LoadReport struct {
+	// CPUUtilization is the CPU usage of the server, from 0 to 1.
+	CPUUtilization float64
+	// QPS is the number of requests the server completed per second.
+	QPS float64
+	// InFlight is the number of requests the server is handling.
+	InFlight int64
+}
+
+func (r LoadReport) String() string {
+	return fmt.Sprintf("cpu=%.4f,qps=%.2f,inflight=%d", r.CPUUtilization, r.QPS, r.InFlight)
+}
+
+// ParseLoadReport parses a load report in the format of LoadReport.String.
+// Unknown fields are ignored.
+func ParseLoadReport(s string) (LoadReport, error) {
+	var r LoadReport
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return r, fmt.Errorf("grpclb: invalid load report field %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "cpu":
+			r.CPUUtilization, err = strconv.ParseFloat(kv[1], 64)
+		case "qps":
+			r.QPS, err = strconv.ParseFloat(kv[1], 64)
+		case "inflight":
+			r.InFlight, err = strconv.ParseInt(kv[1], 10, 64)
+		}
+		if err != nil {
+			return r, fmt.Errorf("grpclb: invalid load report field %q: %v", field, err)
+		}
+	}
+	return r, nil
+}
+
+// LoadReporter measures the QPS and in-flight requests of a server and
+// attaches its load report to every response. The CPU utilization is set by
+// the application, e.g. from a periodic sample of the process.
+type LoadReporter struct {
+	cpu      uint64 // math.Float64bits of the utilization
+	inflight int64
+
+	mu          sync.Mutex
+	count       int
+	windowStart time.Time
+	qps         float64
+}
+
+func NewLoadReporter() *LoadReporter {
+	return &LoadReporter{windowStart: time.Now()}
+}
+
+func (r *LoadReporter) SetCPUUtilization(utilization float64) {
+	atomic.StoreUint64(&r.cpu, math.Float64bits(utilization))
+}
+
+// Report returns the current load of the server.
+func (r *LoadReporter) Report() LoadReport {
+	r.mu.Lock()
+	qps := r.qps
+	r.mu.Unlock()
+	return LoadReport{
+		CPUUtilization: math.Float64frombits(atomic.LoadUint64(&r.cpu)),
+		QPS:            qps,
+		InFlight:       atomic.LoadInt64(&r.inflight),
+	}
+}
+
+// completed counts a request in the QPS, measured over one second windows.
+func (r *LoadReporter) completed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.count++
+	if elapsed := time.Since(r.windowStart); elapsed >= time.Second {
+		r.qps = float64(r.count) / elapsed.Seconds()
+		r.count = 0
+		r.windowStart = time.Now()
+	}
+}
+
+// UnaryServerInterceptor returns an interceptor that measures the requests and
+// sets the load report in the trailing metadata of every response.
+func (r *LoadReporter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		atomic.AddInt64(&r.inflight, 1)
+		resp, err := handler(ctx, req)
+		atomic.AddInt64(&r.inflight, -1)
+		r.completed()
+		grpc.SetTrailer(ctx, metadata.Pairs(LoadReportKey, r.Report().String()))
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor is the streaming version of UnaryServerInterceptor,
+// a stream counts as one request.
+func (r *LoadReporter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		atomic.AddInt64(&r.inflight, 1)
+		err := handler(srv, ss)
+		atomic.AddInt64(&r.inflight, -1)
+		r.completed()
+		ss.SetTrailer(metadata.Pairs(LoadReportKey, r.Report().String()))
+		return err
+	}
+}
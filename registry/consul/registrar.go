@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	consul "github.com/hashicorp/consul/api"
+	"github.com/liyue201/grpc-lb/common"
 	"github.com/liyue201/grpc-lb/registry"
 	"google.golang.org/grpc/grpclog"
 	"sync"
@@ -43,6 +44,10 @@ func (c *Registrar) Register(service *registry.ServiceInfo) error {
 	}
 	tags := make([]string, 0)
 	tags = append(tags, string(metadata))
+	meta := map[string]string{}
+	if service.Locality != "" {
+		meta[common.LocalityKey] = service.Locality
+	}
 
 	register := func() error {
 		regis := &consul.AgentServiceRegistration{
@@ -50,6 +55,7 @@ func (c *Registrar) Register(service *registry.ServiceInfo) error {
 			Name:    service.Name + ":" + service.Version,
 			Address: service.Address,
 			Tags:    tags,
+			Meta:    meta,
 			Check: &consul.AgentServiceCheck{
 				TTL:                            fmt.Sprintf("%ds", c.cfg.Ttl),
 				Status:                         consul.HealthPassing,
@@ -2,22 +2,26 @@ package consul
 
 import (
 	con_api "github.com/hashicorp/consul/api"
+	"github.com/liyue201/grpc-lb/registry"
 	"google.golang.org/grpc/resolver"
 	"sync"
 )
 
 type consulResolver struct {
-	scheme      string
-	consulConf  *con_api.Config
-	ServiceName string
-	watcher     *ConsulWatcher
-	cc          resolver.ClientConn
-	wg          sync.WaitGroup
+	scheme       string
+	consulConf   *con_api.Config
+	ServiceNames []string
+	watchers     []*ConsulWatcher
+	cc           resolver.ClientConn
+	wg           sync.WaitGroup
 }
 
 func (r *consulResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
 	r.cc = cc
-	r.watcher = newConsulWatcher(r.ServiceName, r.consulConf)
+	r.watchers = nil
+	for _, name := range r.ServiceNames {
+		r.watchers = append(r.watchers, newConsulWatcher(name, r.consulConf))
+	}
 	r.start()
 	return r, nil
 }
@@ -27,28 +31,51 @@ func (r *consulResolver) Scheme() string {
 }
 
 func (r *consulResolver) start() {
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		out := r.watcher.Watch()
-		for addr := range out {
-			r.cc.UpdateState(resolver.State{Addresses: addr})
-		}
-	}()
+	merger := registry.NewAddressMerger(len(r.watchers))
+	for i, w := range r.watchers {
+		r.wg.Add(1)
+		go func(i int, w *ConsulWatcher) {
+			defer r.wg.Done()
+			out := w.Watch()
+			for addr := range out {
+				merger.Update(i, addr, func(addrs []resolver.Address) {
+					r.cc.UpdateState(resolver.State{Addresses: addrs})
+				})
+			}
+		}(i, w)
+	}
 }
 
 func (r *consulResolver) ResolveNow(o resolver.ResolveNowOptions) {
 }
 
 func (r *consulResolver) Close() {
-	r.watcher.Close()
+	for _, w := range r.watchers {
+		w.Close()
+	}
 	r.wg.Wait()
 }
 
+// RegisterResolver registers a resolver for srvName, which is the consul
+// service name "name:version" used by Registrar.
 func RegisterResolver(scheme string, consulConf *con_api.Config, srvName string) {
 	resolver.Register(&consulResolver{
-		scheme:      scheme,
-		consulConf:  consulConf,
-		ServiceName: srvName,
+		scheme:       scheme,
+		consulConf:   consulConf,
+		ServiceNames: []string{srvName},
+	})
+}
+
+// RegisterMultiVersionResolver registers a resolver that watches several
+// versions of a service and resolves to the instances of all of them.
+func RegisterMultiVersionResolver(scheme string, consulConf *con_api.Config, srvName string, srvVersions []string) {
+	var names []string
+	for _, srvVersion := range srvVersions {
+		names = append(names, srvName+":"+srvVersion)
+	}
+	resolver.Register(&consulResolver{
+		scheme:       scheme,
+		consulConf:   consulConf,
+		ServiceNames: names,
 	})
 }
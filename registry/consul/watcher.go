@@ -5,9 +5,12 @@ import (
 	"encoding/json"
 	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/api/watch"
+	"github.com/liyue201/grpc-lb/common"
+	"github.com/liyue201/grpc-lb/registry"
 	"google.golang.org/grpc/grpclog"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
+	"strings"
 	"sync"
 )
 
@@ -79,18 +82,33 @@ func (w *ConsulWatcher) handle(idx uint64, data interface{}) {
 							grpclog.Infof("Parse node data error:", err)
 						}
 					}
-					addrs = append(addrs, resolver.Address{Addr: e.Service.Address, Metadata: &md})
+					serviceInfo := registry.ServiceInfo{
+						Address:  e.Service.Address,
+						Version:  w.version(),
+						Locality: e.Service.Meta[common.LocalityKey],
+						Metadata: md,
+					}
+					addrs = append(addrs, serviceInfo.ResolverAddress())
 				}
 				break
 			}
 		}
 	}
-	if !isSameAddrs(w.addrs, addrs) {
+	// an empty first list is reported too, the resolver waits for it
+	if w.addrs == nil || !isSameAddrs(w.addrs, addrs) {
 		w.addrs = addrs
 		w.addrsChan <- w.cloneAddresses(w.addrs)
 	}
 }
 
+// version returns the version part of the "name:version" service name.
+func (w *ConsulWatcher) version() string {
+	if i := strings.LastIndex(w.serviceName, ":"); i >= 0 {
+		return w.serviceName[i+1:]
+	}
+	return ""
+}
+
 func (w *ConsulWatcher) cloneAddresses(in []resolver.Address) []resolver.Address {
 	out := make([]resolver.Address, len(in))
 	for i := 0; i < len(in); i++ {
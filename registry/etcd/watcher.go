@@ -52,10 +52,7 @@ func (w *Watcher) GetAllAddresses() []resolver.Address {
 			grpclog.Infof("Parse node data error:", err)
 			continue
 		}
-		addrs = append(addrs, resolver.Address{
-			Addr:     serviceInfo.Address,
-			Metadata: &serviceInfo.Metadata,
-		})
+		addrs = append(addrs, serviceInfo.ResolverAddress())
 	}
 	return addrs
 }
@@ -93,7 +90,7 @@ func (w *Watcher) Watch() chan []resolver.Address {
 					grpclog.Infof("Parse node data error:", err)
 					continue
 				}
-				addr := resolver.Address{Addr: nodeData.Address, Metadata: &nodeData.Metadata}
+				addr := nodeData.ResolverAddress()
 				changed := false
 				switch resp.Action {
 				case "set", "create":
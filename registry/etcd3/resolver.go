@@ -2,17 +2,18 @@ package etcd
 
 import (
 	etcd_cli "github.com/coreos/etcd/clientv3"
+	"github.com/liyue201/grpc-lb/registry"
 	"google.golang.org/grpc/resolver"
 	"sync"
 )
 
 type etcdResolver struct {
-	scheme        string
-	etcdConfig    etcd_cli.Config
-	etcdWatchPath string
-	watcher       *Watcher
-	cc            resolver.ClientConn
-	wg            sync.WaitGroup
+	scheme         string
+	etcdConfig     etcd_cli.Config
+	etcdWatchPaths []string
+	watchers       []*Watcher
+	cc             resolver.ClientConn
+	wg             sync.WaitGroup
 }
 
 func (r *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
@@ -21,7 +22,10 @@ func (r *etcdResolver) Build(target resolver.Target, cc resolver.ClientConn, opt
 		return nil, err
 	}
 	r.cc = cc
-	r.watcher = newWatcher(r.etcdWatchPath, etcdCli)
+	r.watchers = nil
+	for _, path := range r.etcdWatchPaths {
+		r.watchers = append(r.watchers, newWatcher(path, etcdCli))
+	}
 	r.start()
 	return r, nil
 }
@@ -31,28 +35,45 @@ func (r *etcdResolver) Scheme() string {
 }
 
 func (r *etcdResolver) start() {
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		out := r.watcher.Watch()
-		for addr := range out {
-			r.cc.UpdateState(resolver.State{Addresses: addr})
-		}
-	}()
+	merger := registry.NewAddressMerger(len(r.watchers))
+	for i, w := range r.watchers {
+		r.wg.Add(1)
+		go func(i int, w *Watcher) {
+			defer r.wg.Done()
+			out := w.Watch()
+			for addr := range out {
+				merger.Update(i, addr, func(addrs []resolver.Address) {
+					r.cc.UpdateState(resolver.State{Addresses: addrs})
+				})
+			}
+		}(i, w)
+	}
 }
 
 func (r *etcdResolver) ResolveNow(o resolver.ResolveNowOptions) {
 }
 
 func (r *etcdResolver) Close() {
-	r.watcher.Close()
+	for _, w := range r.watchers {
+		w.Close()
+	}
 	r.wg.Wait()
 }
 
 func RegisterResolver(scheme string, etcdConfig etcd_cli.Config, registryDir, srvName, srvVersion string) {
+	RegisterMultiVersionResolver(scheme, etcdConfig, registryDir, srvName, []string{srvVersion})
+}
+
+// RegisterMultiVersionResolver registers a resolver that watches several
+// versions of a service and resolves to the instances of all of them.
+func RegisterMultiVersionResolver(scheme string, etcdConfig etcd_cli.Config, registryDir, srvName string, srvVersions []string) {
+	var paths []string
+	for _, srvVersion := range srvVersions {
+		paths = append(paths, registryDir+"/"+srvName+"/"+srvVersion)
+	}
 	resolver.Register(&etcdResolver{
-		scheme:        scheme,
-		etcdConfig:    etcdConfig,
-		etcdWatchPath: registryDir + "/" + srvName + "/" + srvVersion,
+		scheme:         scheme,
+		etcdConfig:     etcdConfig,
+		etcdWatchPaths: paths,
 	})
 }
@@ -43,11 +43,7 @@ func (w *Watcher) GetAllAddresses() []resolver.Address {
 		addrs := extractAddrs(resp)
 		if len(addrs) > 0 {
 			for _, addr := range addrs {
-				v := addr
-				ret = append(ret, resolver.Address{
-					Addr:     v.Address,
-					Metadata: &v.Metadata,
-				})
+				ret = append(ret, addr.ResolverAddress())
 			}
 		}
 	}
@@ -76,7 +72,7 @@ func (w *Watcher) Watch() chan []resolver.Address {
 						grpclog.Error("Parse node data error:", err)
 						continue
 					}
-					addr := resolver.Address{Addr: nodeData.Address, Metadata: &nodeData.Metadata}
+					addr := nodeData.ResolverAddress()
 					if w.addAddr(addr) {
 						out <- w.cloneAddresses(w.addrs)
 					}
@@ -87,7 +83,7 @@ func (w *Watcher) Watch() chan []resolver.Address {
 						grpclog.Error("Parse node data error:", err)
 						continue
 					}
-					addr := resolver.Address{Addr: nodeData.Address, Metadata: &nodeData.Metadata}
+					addr := nodeData.ResolverAddress()
 					if w.removeAddr(addr) {
 						out <- w.cloneAddresses(w.addrs)
 					}
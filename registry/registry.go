@@ -1,7 +1,10 @@
 package registry
 
 import (
+	"github.com/liyue201/grpc-lb/common"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"sync"
 )
 
 type ServiceInfo struct {
@@ -9,7 +12,68 @@ type ServiceInfo struct {
 	Name       string
 	Version    string
 	Address    string
-	Metadata   metadata.MD
+	// Locality is the zone the instance runs in, e.g. "us-east-1a".
+	Locality string
+	Metadata metadata.MD
+}
+
+// ResolverAddress returns the address watchers pass to gRPC for the service.
+// The version and locality are added to a copy of the metadata under
+// common.VersionKey and common.LocalityKey.
+func (s *ServiceInfo) ResolverAddress() resolver.Address {
+	md := s.Metadata.Copy()
+	if s.Version != "" {
+		md.Set(common.VersionKey, s.Version)
+	}
+	if s.Locality != "" {
+		md.Set(common.LocalityKey, s.Locality)
+	}
+	return resolver.Address{Addr: s.Address, Metadata: &md}
+}
+
+// AddressMerger merges the addresses of several watchers, e.g. one per
+// version of a service, into a single list.
+type AddressMerger struct {
+	mu      sync.Mutex
+	lists   [][]resolver.Address
+	waiting []bool // no list reported yet
+	pending int    // number of watchers waiting
+}
+
+func NewAddressMerger(n int) *AddressMerger {
+	m := &AddressMerger{
+		lists:   make([][]resolver.Address, n),
+		waiting: make([]bool, n),
+		pending: n,
+	}
+	for i := range m.waiting {
+		m.waiting[i] = true
+	}
+	return m
+}
+
+// Update replaces the addresses of the i-th watcher and calls fn with the
+// merged addresses once every watcher reported its first list, so that gRPC
+// does not start with the instances of only some versions. A watcher that
+// cannot watch reports nil. Calls of fn are serialized, so that an older list
+// never overwrites a newer one.
+func (m *AddressMerger) Update(i int, addrs []resolver.Address, fn func([]resolver.Address)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lists[i] = addrs
+	if m.waiting[i] {
+		m.waiting[i] = false
+		m.pending--
+	}
+	if m.pending > 0 {
+		return
+	}
+	merged := []resolver.Address{}
+	for _, list := range m.lists {
+		merged = append(merged, list...)
+	}
+	fn(merged)
 }
 
 type Registrar interface {
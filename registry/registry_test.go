@@ -0,0 +1,30 @@
+package registry
+
+import (
+	"google.golang.org/grpc/resolver"
+	"reflect"
+	"testing"
+)
+
+func TestAddressMerger(t *testing.T) {
+	m := NewAddressMerger(3)
+	var updates [][]resolver.Address
+	update := func(addrs []resolver.Address) {
+		updates = append(updates, addrs)
+	}
+	a := resolver.Address{Addr: "10.0.0.1:8080"}
+	b := resolver.Address{Addr: "10.0.0.2:8080"}
+
+	m.Update(0, []resolver.Address{a}, update)
+	m.Update(0, []resolver.Address{a, b}, update)
+	m.Update(2, nil, update)
+	if len(updates) != 0 {
+		t.Fatalf("%d updates before every watcher reported, want 0", len(updates))
+	}
+	m.Update(1, []resolver.Address{}, update)
+	m.Update(0, []resolver.Address{b}, update)
+	want := [][]resolver.Address{{a, b}, {b}}
+	if !reflect.DeepEqual(updates, want) {
+		t.Fatalf("updates %v, want %v", updates, want)
+	}
+}
@@ -1,25 +1,32 @@
 package zk
 
 import (
+	"github.com/liyue201/grpc-lb/registry"
 	"google.golang.org/grpc/resolver"
 	"sync"
 )
 
 type zkResolver struct {
-	scheme      string
-	zkServers   []string
-	zkWatchPath string
-	watcher     *Watcher
-	cc          resolver.ClientConn
-	wg          sync.WaitGroup
+	scheme       string
+	zkServers    []string
+	zkWatchPaths []string
+	watchers     []*Watcher
+	cc           resolver.ClientConn
+	wg           sync.WaitGroup
 }
 
 func (r *zkResolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
 	r.cc = cc
-	var err error
-	r.watcher, err = newWatcher(r.zkServers, r.zkWatchPath)
-	if err != nil {
-		return nil, err
+	r.watchers = nil
+	for _, path := range r.zkWatchPaths {
+		w, err := newWatcher(r.zkServers, path)
+		if err != nil {
+			for _, w := range r.watchers {
+				w.Close()
+			}
+			return nil, err
+		}
+		r.watchers = append(r.watchers, w)
 	}
 	r.start()
 	return r, nil
@@ -30,30 +37,52 @@ func (r *zkResolver) Scheme() string {
 }
 
 func (r *zkResolver) start() {
-	r.wg.Add(1)
-	go func() {
-		defer r.wg.Done()
-		out := r.watcher.Watch()
-		if out != nil {
+	merger := registry.NewAddressMerger(len(r.watchers))
+	for i, w := range r.watchers {
+		r.wg.Add(1)
+		go func(i int, w *Watcher) {
+			defer r.wg.Done()
+			update := func(addrs []resolver.Address) {
+				r.cc.UpdateState(resolver.State{Addresses: addrs})
+			}
+			out := w.Watch()
+			if out == nil {
+				// the path cannot be watched, count it as empty so that the
+				// other watchers are not kept waiting
+				merger.Update(i, nil, update)
+				return
+			}
 			for addr := range out {
-				r.cc.UpdateState(resolver.State{Addresses: addr})
+				merger.Update(i, addr, update)
 			}
-		}
-	}()
+		}(i, w)
+	}
 }
 
 func (r *zkResolver) ResolveNow(o resolver.ResolveNowOptions) {
 }
 
 func (r *zkResolver) Close() {
-	r.watcher.Close()
+	for _, w := range r.watchers {
+		w.Close()
+	}
 	r.wg.Wait()
 }
 
 func RegisterResolver(scheme string, zkServers []string, registryDir, srvName, srvVersion string) {
+	RegisterMultiVersionResolver(scheme, zkServers, registryDir, srvName, []string{srvVersion})
+}
+
+// RegisterMultiVersionResolver registers a resolver that watches several
+// versions of a service and resolves to the instances of all of them.
+func RegisterMultiVersionResolver(scheme string, zkServers []string, registryDir, srvName string, srvVersions []string) {
+	var paths []string
+	for _, srvVersion := range srvVersions {
+		paths = append(paths, registryDir+"/"+srvName+"/"+srvVersion)
+	}
 	resolver.Register(&zkResolver{
-		scheme:      scheme,
-		zkServers:   zkServers,
-		zkWatchPath: registryDir + "/" + srvName + "/" + srvVersion,
+		scheme:       scheme,
+		zkServers:    zkServers,
+		zkWatchPaths: paths,
 	})
 }
@@ -65,10 +65,11 @@ func (w *Watcher) Watch() chan []resolver.Address {
 				if err != nil {
 					continue
 				}
-				addrs = append(addrs, resolver.Address{Addr: nodeData.Address, Metadata: &nodeData.Metadata})
+				addrs = append(addrs, nodeData.ResolverAddress())
 			}
 
-			if !isSameAddrs(w.addrs, addrs) {
+			// the first list is sent even if empty
+			if w.addrs == nil || !isSameAddrs(w.addrs, addrs) {
 				w.addrs = addrs
 				addrChan <- w.cloneAddresses(addrs)
 			}